@@ -0,0 +1,98 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// cardinalityTracker counts the distinct series of each measurement within a
+// window and warns when a measurement exceeds a threshold. It is not safe for
+// concurrent use.
+type cardinalityTracker struct {
+	threshold int
+	window    time.Duration
+	logger    log.Logger
+
+	start        time.Time
+	measurements map[string]*measurementSeries
+}
+
+type measurementSeries struct {
+	ids map[string]struct{}
+	// Distinct values of each label.
+	values map[string]map[string]struct{}
+	warned bool
+}
+
+func newCardinalityTracker(threshold int, window time.Duration, logger log.Logger) *cardinalityTracker {
+	return &cardinalityTracker{
+		threshold:    threshold,
+		window:       window,
+		logger:       logger,
+		measurements: map[string]*measurementSeries{},
+	}
+}
+
+// observe records a sample, warning once per window for a measurement that
+// has more than threshold distinct series.
+func (t *cardinalityTracker) observe(s *influxDBSample, now time.Time) {
+	if now.Sub(t.start) > t.window {
+		t.start = now
+		t.measurements = map[string]*measurementSeries{}
+	}
+
+	m, ok := t.measurements[s.Measurement]
+	if !ok {
+		m = &measurementSeries{ids: map[string]struct{}{}, values: map[string]map[string]struct{}{}}
+		t.measurements[s.Measurement] = m
+	}
+	if m.warned {
+		return
+	}
+	if _, ok := m.ids[s.ID]; ok {
+		return
+	}
+	m.ids[s.ID] = struct{}{}
+	for k, v := range s.Labels {
+		if m.values[k] == nil {
+			m.values[k] = map[string]struct{}{}
+		}
+		m.values[k][v] = struct{}{}
+	}
+
+	if len(m.ids) > t.threshold {
+		m.warned = true
+		cardinalityWarnings.Inc()
+		tag, values := m.suspectLabel()
+		level.Warn(t.logger).Log("msg", "Measurement exceeds series threshold", "measurement", s.Measurement, "series", len(m.ids), "threshold", t.threshold, "window", t.window, "suspect_tag", tag, "suspect_tag_values", values)
+	}
+}
+
+// suspectLabel returns the label with the most distinct values.
+func (m *measurementSeries) suspectLabel() (string, int) {
+	var (
+		label string
+		most  int
+	)
+	for k, values := range m.values {
+		if len(values) > most || (len(values) == most && k < label) {
+			label, most = k, len(values)
+		}
+	}
+	return label, most
+}
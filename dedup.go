@@ -0,0 +1,73 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// dedupCache is an LRU of hashes of recently seen sample IDs and timestamps.
+// It is not safe for concurrent use.
+type dedupCache struct {
+	window  time.Duration
+	size    int
+	lru     *list.List
+	entries map[uint64]*list.Element
+}
+
+type dedupEntry struct {
+	key  uint64
+	seen time.Time
+}
+
+func newDedupCache(window time.Duration, size int) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		size:    size,
+		lru:     list.New(),
+		entries: map[uint64]*list.Element{},
+	}
+}
+
+// seen reports whether a sample with the same ID and timestamp was seen within
+// the window, and records the sample as seen at now otherwise.
+func (d *dedupCache) seen(s *influxDBSample, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write([]byte(s.ID))
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(s.Timestamp.UnixNano()))
+	h.Write(ts[:])
+	key := h.Sum64()
+
+	if e, ok := d.entries[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.seen) <= d.window {
+			return true
+		}
+		entry.seen = now
+		d.lru.MoveToFront(e)
+		return false
+	}
+
+	d.entries[key] = d.lru.PushFront(&dedupEntry{key: key, seen: now})
+	for d.lru.Len() > d.size {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// valueExpr is a compiled arithmetic expression of the sample value x.
+type valueExpr interface {
+	eval(x float64) float64
+}
+
+type (
+	exprConst  float64
+	exprVar    struct{}
+	exprNeg    struct{ e valueExpr }
+	exprBinary struct {
+		op   byte
+		l, r valueExpr
+	}
+)
+
+func (e exprConst) eval(float64) float64 { return float64(e) }
+func (exprVar) eval(x float64) float64   { return x }
+func (e exprNeg) eval(x float64) float64 { return -e.e.eval(x) }
+func (e exprBinary) eval(x float64) float64 {
+	l, r := e.l.eval(x), e.r.eval(x)
+	switch e.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	}
+	return l / r
+}
+
+// parseExpr compiles an expression built from numbers, the variable x, the
+// operators + - * / and parentheses, e.g. "(x - 32) * 5 / 9".
+func parseExpr(s string) (valueExpr, error) {
+	p := &exprParser{s: s}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.s[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, or 0 at the end of the input.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// sum parses terms separated by + and -.
+func (p *exprParser) sum() (valueExpr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = exprBinary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+// product parses factors separated by * and /.
+func (p *exprParser) product() (valueExpr, error) {
+	l, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l = exprBinary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+// factor parses a number, x, a negated factor or a parenthesized expression.
+func (p *exprParser) factor() (valueExpr, error) {
+	switch c := p.peek(); {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == 'x':
+		p.pos++
+		return exprVar{}, nil
+	case c == '-':
+		p.pos++
+		e, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return exprNeg{e}, nil
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] == '.' || (p.s[p.pos] >= '0' && p.s[p.pos] <= '9')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.s[start:p.pos])
+		}
+		return exprConst(v), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestParseExpr(t *testing.T) {
+	for _, tc := range []struct {
+		expr   string
+		x      float64
+		result float64
+	}{
+		{"x - 273.15", 300, 26.850000000000023},
+		{"x*1000", 1.5, 1500},
+		{"(x - 32) * 5 / 9", 212, 100},
+		{"2 + 3 * x", 2, 8},
+		{"-x + -(1)", 2, -3},
+		{"x / 4 / 2", 16, 2},
+		{"x", 7, 7},
+	} {
+		e, err := parseExpr(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %s", tc.expr, err)
+			continue
+		}
+		if got := e.eval(tc.x); got != tc.result {
+			t.Errorf("%q with x=%v: got %v, want %v", tc.expr, tc.x, got, tc.result)
+		}
+	}
+
+	for _, expr := range []string{"", "x +", "(x", "x)", "y", "1.2.3", "x x"} {
+		if _, err := parseExpr(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+func TestFieldExpr(t *testing.T) {
+	defer func(v map[string]valueExpr) { fieldExprs = v }(fieldExprs)
+	fieldExprs = map[string]valueExpr{}
+	for field, expr := range map[string]string{"temp_k": "x - 273.15", "load": "x * 100"} {
+		e, err := parseExpr(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fieldExprs[field] = e
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "sensor temp_k=300i,load=0.25,other=1\n")
+	waitForSamples(t, c, 3)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, want := range map[string]float64{"sensor_temp_k": 26.850000000000023, "sensor_load": 25, "sensor_other": 1} {
+		if got := c.samples[id].Value; got != want {
+			t.Errorf("%s: got %v, want %v", id, got, want)
+		}
+	}
+}
@@ -2,8 +2,10 @@ module github.com/prometheus/influxdb_exporter
 
 require (
 	github.com/go-kit/kit v0.10.0
+	github.com/golang/protobuf v1.4.0
 	github.com/influxdata/influxdb v1.8.0
 	github.com/prometheus/client_golang v1.6.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.10.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
@@ -0,0 +1,138 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	graphiteBatchSize   = 1000
+	graphiteDialTimeout = 5 * time.Second
+)
+
+// graphiteForwarder forwards samples to a carbon endpoint using the plaintext
+// protocol with Graphite tags.
+type graphiteForwarder struct {
+	address       string
+	flushInterval time.Duration
+	ch            chan *influxDBSample
+	logger        log.Logger
+
+	conn    net.Conn
+	buf     bytes.Buffer
+	pending int
+}
+
+func newGraphiteForwarder(address string, flushInterval time.Duration, logger log.Logger) *graphiteForwarder {
+	return &graphiteForwarder{
+		address:       address,
+		flushInterval: flushInterval,
+		ch:            make(chan *influxDBSample, graphiteBatchSize),
+		logger:        logger,
+	}
+}
+
+// forward queues a sample, dropping it if the forwarder can't keep up.
+func (f *graphiteForwarder) forward(s *influxDBSample) {
+	select {
+	case f.ch <- s:
+	default:
+		graphiteDroppedSamples.Inc()
+	}
+}
+
+// run batches queued samples and sends them to the carbon endpoint.
+func (f *graphiteForwarder) run() {
+	ticker := time.NewTicker(f.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case s := <-f.ch:
+			writeGraphiteLine(&f.buf, s)
+			f.pending++
+			if f.pending >= graphiteBatchSize {
+				f.flush()
+			}
+		case <-ticker.C:
+			f.flush()
+		}
+	}
+}
+
+// flush sends the current batch, reconnecting if needed. A batch that can't
+// be sent is dropped so that a dead endpoint does not grow the buffer.
+func (f *graphiteForwarder) flush() {
+	if f.pending == 0 {
+		return
+	}
+	defer func() {
+		f.buf.Reset()
+		f.pending = 0
+	}()
+
+	if f.conn == nil {
+		conn, err := net.DialTimeout("tcp", f.address, graphiteDialTimeout)
+		if err != nil {
+			level.Warn(f.logger).Log("msg", "Failed to connect to graphite", "address", f.address, "err", err)
+			graphiteDroppedSamples.Add(float64(f.pending))
+			return
+		}
+		f.conn = conn
+	}
+	if _, err := f.conn.Write(f.buf.Bytes()); err != nil {
+		level.Warn(f.logger).Log("msg", "Failed to write to graphite", "address", f.address, "err", err)
+		graphiteDroppedSamples.Add(float64(f.pending))
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// writeGraphiteLine writes a sample as "name;tag=value value timestamp".
+func writeGraphiteLine(buf *bytes.Buffer, s *influxDBSample) {
+	buf.WriteString(s.Name)
+
+	keys := make([]string, 0, len(s.Labels))
+	for k, v := range s.Labels {
+		// Graphite does not allow empty tag values.
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(';')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(graphiteTagValueReplacer.Replace(s.Labels[k]))
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(s.Value, 'f', -1, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(s.Timestamp.Unix(), 10))
+	buf.WriteByte('\n')
+}
+
+// graphiteTagValueReplacer replaces characters that are not allowed in
+// Graphite tag values or that would break the plaintext protocol.
+var graphiteTagValueReplacer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_")
@@ -0,0 +1,58 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestGraphiteForwarder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	c.graphite = newGraphiteForwarder(l.Addr().String(), 10*time.Millisecond, log.NewNopLogger())
+	go c.graphite.run()
+
+	writeLines(t, c, "cpu,host=a\\ b,core=0 usage=1.5 1600000000000000000\nmem value=2 1600000001000000000\n")
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	for _, want := range []string{
+		"cpu_usage;core=0;host=a_b 1.5 1600000000\n",
+		"mem 2 1600000001\n",
+	} {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got line %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// historyPoint is a value of a series kept for /-/series.
+type historyPoint struct {
+	timestamp time.Time
+	value     float64
+}
+
+// recordHistory appends the value of s to the history of its series, keeping
+// the most recent --series.history values. It must be called with mu held,
+// before s is stored.
+func (c *influxDBCollector) recordHistory(s *influxDBSample) {
+	key := sampleKey(s)
+	h := c.history[key]
+	p := historyPoint{timestamp: s.Timestamp, value: s.Value}
+	if len(h) < *seriesHistory {
+		c.history[key] = append(h, p)
+		return
+	}
+	copy(h, h[1:])
+	h[len(h)-1] = p
+}
+
+// series writes the recent values of the series given by the id query
+// parameter as JSON. Like the Prometheus query API, values are pairs of a
+// Unix timestamp in seconds and the value as a string, oldest first.
+func (c *influxDBCollector) series(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		JSONErrorResponse(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	s := c.sampleByID(id)
+	var points []historyPoint
+	if c.history != nil {
+		points = append(points, c.history[id]...)
+	} else if s != nil {
+		points = []historyPoint{{timestamp: s.Timestamp, value: s.Value}}
+	}
+	c.mu.Unlock()
+	if s == nil {
+		JSONErrorResponse(w, "unknown series "+strconv.Quote(id), http.StatusNotFound)
+		return
+	}
+
+	values := make([][2]interface{}, 0, len(points))
+	for _, p := range points {
+		values = append(values, [2]interface{}{
+			float64(p.timestamp.UnixNano()) / 1e9,
+			strconv.FormatFloat(p.value, 'f', -1, 64),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID     string            `json:"id"`
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+		Values [][2]interface{}  `json:"values"`
+	}{id, s.Name, s.Labels, values})
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSeriesHistory(t *testing.T) {
+	defer func(v int) { *seriesHistory = v }(*seriesHistory)
+	*seriesHistory = 3
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	base := time.Now().Truncate(time.Second)
+	for i := 1; i <= 4; i++ {
+		writeLines(t, c, fmt.Sprintf("cpu,host=a usage=%d %d\n", i, base.Add(time.Duration(i)*time.Second).UnixNano()))
+	}
+	// Samples are processed in order, so all values of cpu are recorded once
+	// this one is stored.
+	writeLines(t, c, "done value=1\n")
+	waitForSamples(t, c, 2)
+
+	h := newHandler(c, prometheus.NewRegistry())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/-/series?id=cpu_usage.host.a", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got struct {
+		Name   string
+		Labels map[string]string
+		Values [][2]interface{}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "cpu_usage" || got.Labels["host"] != "a" {
+		t.Errorf("got series %s %v, want cpu_usage with host a", got.Name, got.Labels)
+	}
+	// Only the three most recent values are kept.
+	var want [][2]interface{}
+	for i := 2; i <= 4; i++ {
+		want = append(want, [2]interface{}{float64(base.Unix() + int64(i)), fmt.Sprint(i)})
+	}
+	if !reflect.DeepEqual(got.Values, want) {
+		t.Errorf("got values %v, want %v", got.Values, want)
+	}
+
+	for target, code := range map[string]int{
+		"/-/series":            http.StatusBadRequest,
+		"/-/series?id=unknown": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != code {
+			t.Errorf("%s: got status %d, want %d", target, rec.Code, code)
+		}
+	}
+
+	// Expired series lose their history.
+	c.expireSamples(time.Now().Add(time.Hour))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.history) != 0 {
+		t.Errorf("got history of %d series after expiry, want none", len(c.history))
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+)
+
+// splitLines splits line protocol into lines, dropping blank lines and
+// comments. Newlines inside quoted string field values do not end a line.
+func splitLines(buf []byte) [][]byte {
+	var lines [][]byte
+	start := 0
+	section, quoted := 0, false
+	for i := 0; i <= len(buf); i++ {
+		if i < len(buf) {
+			switch c := buf[i]; {
+			case c == '\\' && i+1 < len(buf):
+				i++
+				continue
+			case c == ' ' && !quoted:
+				if i > start && buf[i-1] != ' ' {
+					section++
+				}
+				continue
+			case c == '"' && section == 1:
+				quoted = !quoted
+				continue
+			case c != '\n' || quoted:
+				continue
+			}
+		}
+		line := bytes.TrimSpace(buf[start:i])
+		if len(line) > 0 && line[0] != '#' {
+			lines = append(lines, line)
+		}
+		start = i + 1
+		section, quoted = 0, false
+	}
+	return lines
+}
+
+// lineSections splits a single line into its key, fields and timestamp
+// sections. The timestamp is empty if the line does not have one.
+func lineSections(line []byte) (key, fields, timestamp []byte) {
+	var sections [3][]byte
+	section, start, quoted := 0, 0, false
+	for i := 0; i < len(line) && section < len(sections); i++ {
+		switch c := line[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && section == 1:
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if i > start {
+				sections[section] = line[start:i]
+				section++
+			}
+			start = i + 1
+		}
+	}
+	if section < len(sections) && start < len(line) {
+		sections[section] = line[start:]
+	}
+	return sections[0], sections[1], sections[2]
+}
+
+// timestampedLines returns the lines of buf that have a timestamp, and the
+// number of lines that were dropped for not having one.
+func timestampedLines(buf []byte) ([]byte, int) {
+	var (
+		out     []byte
+		dropped int
+	)
+	for _, line := range splitLines(buf) {
+		if _, _, timestamp := lineSections(line); len(timestamp) == 0 {
+			dropped++
+			continue
+		}
+		out = append(append(out, line...), '\n')
+	}
+	return out, dropped
+}
+
+// guessPrecision guesses the precision of the first timestamp in buf from its
+// number of digits: up to 11 digits are seconds, up to 14 milliseconds, up to
+// 17 microseconds and anything longer nanoseconds. This is right for
+// timestamps between 1973 and 2286, but not for earlier ones. Without a
+// timestamp the precision is nanoseconds.
+func guessPrecision(buf []byte) string {
+	for _, line := range splitLines(buf) {
+		_, _, timestamp := lineSections(line)
+		if len(timestamp) == 0 {
+			continue
+		}
+		digits := len(bytes.TrimPrefix(timestamp, []byte{'-'}))
+		switch {
+		case digits <= 11:
+			return "s"
+		case digits <= 14:
+			return "ms"
+		case digits <= 17:
+			return "u"
+		}
+		return "ns"
+	}
+	return "ns"
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	in := "# comment\ncpu value=1 1\n\n  log msg=\"multi\nline\" 2\r\nmem\\ used=3\n"
+	want := []string{"cpu value=1 1", "log msg=\"multi\nline\" 2", "mem\\ used=3"}
+
+	got := splitLines([]byte(in))
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines %q, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLineSections(t *testing.T) {
+	for _, tc := range []struct {
+		line            string
+		key, fields, ts string
+	}{
+		{"cpu value=1", "cpu", "value=1", ""},
+		{"cpu,host=a value=1 1600000000", "cpu,host=a", "value=1", "1600000000"},
+		{`my\ cpu,host=a\ b msg="x y",value=1   123`, `my\ cpu,host=a\ b`, `msg="x y",value=1`, "123"},
+	} {
+		key, fields, ts := lineSections([]byte(tc.line))
+		if string(key) != tc.key || string(fields) != tc.fields || string(ts) != tc.ts {
+			t.Errorf("%q: got (%q, %q, %q), want (%q, %q, %q)", tc.line, key, fields, ts, tc.key, tc.fields, tc.ts)
+		}
+	}
+}
+
+func TestGuessPrecision(t *testing.T) {
+	for in, want := range map[string]string{
+		"cpu value=1 1600000000\n":                   "s",
+		"cpu value=1 1600000000123\n":                "ms",
+		"cpu value=1 1600000000123456\n":             "u",
+		"cpu value=1 1600000000123456789\n":          "ns",
+		"cpu value=1\nmem value=2 1600000000123\n":   "ms",
+		"cpu value=1\n":                              "ns",
+		"# 1600000000\ncpu,host=a\\ b value=1 123\n": "s",
+	} {
+		if got := guessPrecision([]byte(in)); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -14,20 +14,31 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -40,16 +51,106 @@ import (
 
 const (
 	MAX_UDP_PAYLOAD = 64 * 1024
+
+	// InfluxDB API version reported to clients.
+	influxDBVersion = "1.8.0"
+
+	// staleNaNBits is the bit pattern Prometheus uses for staleness markers.
+	staleNaNBits uint64 = 0x7ff0000000000002
+
+	// Limits for JSON fields flattened with --field.flatten-json.
+	maxFlattenBytes = 64 * 1024
+	maxFlattenDepth = 8
 )
 
 var (
-	listenAddress       = kingpin.Flag("web.listen-address", "Address on which to expose metrics and web interface.").Default(":9122").String()
-	metricsPath         = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
-	exporterMetricsPath = kingpin.Flag("web.exporter-telemetry-path", "Path under which to expose exporter metrics.").Default("/metrics/exporter").String()
-	sampleExpiry        = kingpin.Flag("influxdb.sample-expiry", "How long a sample is valid for.").Default("5m").Duration()
-	bindAddress         = kingpin.Flag("udp.bind-address", "Address on which to listen for udp packets.").Default(":9122").String()
-	exportTimestamp     = kingpin.Flag("timestamps", "Export timestamps of points.").Default("false").Bool()
-	lastPush            = prometheus.NewGauge(
+	listenAddress          = kingpin.Flag("web.listen-address", "Address on which to expose metrics and web interface.").Default(":9122").String()
+	metricsPath            = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
+	exporterMetricsPath    = kingpin.Flag("web.exporter-telemetry-path", "Path under which to expose exporter metrics.").Default("/metrics/exporter").String()
+	sampleExpiry           = kingpin.Flag("influxdb.sample-expiry", "How long a sample is valid for.").Default("5m").Duration()
+	bindAddress            = kingpin.Flag("udp.bind-address", "Address on which to listen for udp packets.").Default(":9122").String()
+	exportTimestamp        = kingpin.Flag("timestamps", "Export timestamps of points.").Default("false").Bool()
+	timestampMaxAge        = kingpin.Flag("timestamp.drop-older-than", "Export samples older than this without their timestamp when --timestamps is set. 0 keeps all timestamps.").Default("0s").Duration()
+	measurementPrecision   = kingpin.Flag("influxdb.measurement-precision", "Timestamp precision of a measurement, overriding the precision of the write. Can be repeated, as measurement=precision.").StringMap()
+	strictNames            = kingpin.Flag("name.strict", "Reject points whose measurement, field or tag key names contain invalid characters instead of sanitizing them.").Default("false").Bool()
+	nameAsLabels           = kingpin.Flag("name.as-labels", "Export all points as a single metric with the measurement and field as labels.").Default("false").Bool()
+	nameAsLabelsMetric     = kingpin.Flag("name.as-labels-metric", "Metric name used when exporting points with --name.as-labels.").Default("influxdb").String()
+	enablePprof            = kingpin.Flag("web.enable-pprof", "Expose the net/http/pprof handlers under /debug/pprof/.").Default("false").Bool()
+	dedupWindow            = kingpin.Flag("write.dedup-window", "Ignore samples with the same series and timestamp as one received within this duration. 0 disables deduplication.").Default("0s").Duration()
+	dedupSize              = kingpin.Flag("write.dedup-size", "Maximum number of samples remembered for deduplication.").Default("100000").Int()
+	graphiteAddress        = kingpin.Flag("graphite.address", "Address of a Graphite carbon endpoint to forward samples to. Disabled if empty.").Default("").String()
+	graphiteFlushInterval  = kingpin.Flag("graphite.flush-interval", "How often samples are sent to Graphite.").Default("1s").Duration()
+	sanitizeValues         = kingpin.Flag("label.sanitize-values", "Replace control characters such as newlines in tag values with underscores.").Default("false").Bool()
+	unitNormalize          = kingpin.Flag("name.unit-normalize", "Rename metrics with a known unit suffix to the base unit and scale their values, see --name.unit-suffix.").Default("false").Bool()
+	unitSuffixFlag         = kingpin.Flag("name.unit-suffix", "Unit suffix normalized by --name.unit-normalize, as suffix=base:scale. Can be repeated, replacing the defaults.").Default("ms=seconds:0.001", "us=seconds:0.000001", "ns=seconds:0.000000001", "milliseconds=seconds:0.001", "microseconds=seconds:0.000001", "nanoseconds=seconds:0.000000001").StringMap()
+	maxLabels              = kingpin.Flag("label.max-count", "Maximum number of labels per series, not counting the labels added by --name.as-labels and --name.dual. 0 means no limit.").Default("0").Int()
+	maxLabelsAction        = kingpin.Flag("label.max-count-action", "What to do with series exceeding --label.max-count: truncate keeps the labels with the lowest names, drop drops the sample.").Default("truncate").Enum("truncate", "drop")
+	maxRequestSize         = kingpin.Flag("web.max-request-size", "Maximum size in bytes of a write request body as transmitted, i.e. before decompression. 0 means no limit.").Default("0").Int64()
+	formatVersion          = kingpin.Flag("web.format-version", "Exposition format of the metrics endpoint. One of negotiate, text-0.0.4, openmetrics-0.0.1, protobuf-delimited, protobuf-text or protobuf-compact.").Default("negotiate").Enum("negotiate", "text-0.0.4", "openmetrics-0.0.1", "protobuf-delimited", "protobuf-text", "protobuf-compact")
+	dropInternal           = kingpin.Flag("drop.internal", "Drop writes to the _internal database and fields whose names start with an underscore.").Default("false").Bool()
+	fieldTypeFlag          = kingpin.Flag("field.type", "Metric type of a field across all measurements, as field=type where type is one of counter, gauge or untyped. Can be repeated.").StringMap()
+	trimPrefix             = kingpin.Flag("name.trim-prefix", "Prefix to strip from measurement names before building metric names.").Default("").String()
+	fieldKeep              = kingpin.Flag("field.keep", "Only export fields whose raw name matches this glob. Can be repeated.").Strings()
+	fieldDrop              = kingpin.Flag("field.drop", "Do not export fields whose raw name matches this glob. Can be repeated.").Strings()
+	familyMaxSeries        = kingpin.Flag("family.max-series", "Maximum number of series exposed per metric family. Excess series are dropped in label order. 0 means no limit.").Default("0").Int()
+	nameDual               = kingpin.Flag("name.dual", "Add the measurement as a label while keeping it in the metric name.").Default("false").Bool()
+	replaceDots            = kingpin.Flag("label.replace-dots", "Replace dots in tag values, see --label.replace-dots-with.").Default("false").Bool()
+	replaceDotsWith        = kingpin.Flag("label.replace-dots-with", "Replacement for dots in tag values when --label.replace-dots is set.").Default("_").String()
+	startupDelay           = kingpin.Flag("startup.delay", "How long after startup the metrics endpoint answers with 503, to give clients time to push.").Default("0s").Duration()
+	staleMarkers           = kingpin.Flag("influxdb.stale-markers", "Expose a Prometheus staleness marker once for each expired series. The marker only survives the protobuf exposition format.").Default("false").Bool()
+	trimFieldSuffix        = kingpin.Flag("name.trim-field-suffix", "Suffix to strip from field names before building metric names.").Default("").String()
+	logRequests            = kingpin.Flag("web.log-requests", "Log every HTTP request.").Default("false").Bool()
+	parseWorkers           = kingpin.Flag("write.parse-workers", "Number of goroutines used to parse a single write request. Lines are split into contiguous chunks, and the parsed points keep their original order.").Default("1").Int()
+	nameCacheSize          = kingpin.Flag("name.cache-size", "Number of sanitized metric names and label names to cache, 0 to disable.").Default("0").Int()
+	nameCollisionsSize     = kingpin.Flag("name.collisions-size", "Number of sanitized metric names remembered to detect names colliding after sanitization.").Default("10000").Int()
+	summaryQuantileFlag    = kingpin.Flag("summary.quantile-field", "Assemble fields into a summary, as field=quantile, e.g. p99=0.99. The count and sum fields of the same point become the summary count and sum. Can be repeated.").StringMap()
+	nameNamespace          = kingpin.Flag("name.namespace", "Namespace prepended to all metric names.").Default("").String()
+	nameSubsystem          = kingpin.Flag("name.subsystem", "Subsystem prepended to all metric names, after the namespace.").Default("").String()
+	reservedLabelPolicy    = kingpin.Flag("label.reserved-policy", "What to do with tags whose sanitized key starts with the reserved __ prefix, one of prefix (prepend key_) or drop.").Default("prefix").Enum("prefix", "drop")
+	inputFormat            = kingpin.Flag("input.format", "Format of write request bodies, one of lineprotocol or ndjson.").Default("lineprotocol").Enum("lineprotocol", "ndjson")
+	emitUp                 = kingpin.Flag("metrics.up", "Always export an up metric with value 1.").Default("false").Bool()
+	upName                 = kingpin.Flag("metrics.up-name", "Name of the metric exported by --metrics.up.").Default("influxdb_exporter_up").String()
+	fieldExprFlag          = kingpin.Flag("field.expr", "Arithmetic expression applied to the values of a field, as field=expression using x for the value, e.g. temp_k=x-273.15. Can be repeated.").StringMap()
+	cardinalityThreshold   = kingpin.Flag("cardinality.warn-threshold", "Log a warning when a measurement has more distinct series than this within --cardinality.window, 0 to disable.").Default("0").Int()
+	cardinalityWindow      = kingpin.Flag("cardinality.window", "Window over which distinct series are counted for --cardinality.warn-threshold.").Default("10m").Duration()
+	requireTimestamp       = kingpin.Flag("timestamp.require", "Skip points without an explicit timestamp instead of using the time they were received.").Default("false").Bool()
+	renderTimeout          = kingpin.Flag("metrics.render-timeout", "Maximum time to spend encoding a scrape response before answering with 503, 0 to disable.").Default("0").Duration()
+	labelRename            = kingpin.Flag("label.rename", "Rename a label after sanitization, as from=to. If a label named to already exists it is kept and from is dropped. Renames apply to the original labels and do not chain. Can be repeated.").StringMap()
+	flattenJSONFields      = kingpin.Flag("field.flatten-json", "String field holding a JSON object whose numeric leaves are exported as measurement_field_key metrics. Can be repeated.").Strings()
+	vmImportURL            = kingpin.Flag("vm.import-url", "URL of a VictoriaMetrics Prometheus import endpoint, e.g. http://localhost:8428/api/v1/import/prometheus, to push samples to. Disabled if empty.").Default("").String()
+	vmPushInterval         = kingpin.Flag("vm.push-interval", "How often samples are pushed to VictoriaMetrics.").Default("15s").Duration()
+	labelValueType         = kingpin.Flag("label.value-type", "Add a value_type label with the original field type, one of int, uint, float or bool, or string for fields mapped with --field.enum. This doubles the series of fields written with different types.").Default("false").Bool()
+	sampleIDHash           = kingpin.Flag("store.sample-id-hash", "Key stored samples by a hash of their name and labels instead of their full ID string, which saves memory with many series.").Default("false").Bool()
+	timestampSkip          = kingpin.Flag("timestamp.skip-measurement", "Measurement, or glob pattern of measurements, whose samples are exported without timestamps even with --timestamps. Can be repeated.").Strings()
+	sortByTime             = kingpin.Flag("output.sort-by-time", "Order the series of each metric family by timestamp instead of by labels.").Default("false").Bool()
+	contentTypeOverride    = kingpin.Flag("export.content-type", "Content-Type header sent verbatim with metrics responses. Requires --web.format-version with a matching media type.").Default("").String()
+	vmRoutes               = kingpin.Flag("vm.route", "Push samples of measurements matching a glob pattern to another VictoriaMetrics import URL, as pattern=url. Unmatched samples go to --vm.import-url. Can be repeated.").StringMap()
+	dropEmptyLabels        = kingpin.Flag("label.drop-empty", "Drop tags whose value is empty or NaN.").Default("false").Bool()
+	requiredLabels         = kingpin.Flag("label.required", "Drop samples without a non-empty value for this label. Can be repeated.").Strings()
+	fieldEnumFlag          = kingpin.Flag("field.enum", "Export a string field as a number, as field=value=number,..., e.g. state=running=1,stopped=0. Can be repeated.").StringMap()
+	fieldEnumDefault       = kingpin.Flag("field.enum-default", "Number exported for values of a --field.enum field that are not mapped. Unmapped values are dropped if empty.").Default("").String()
+	maxConnections         = kingpin.Flag("web.max-connections", "Maximum number of simultaneous HTTP connections. Connections over the limit are closed as soon as they are accepted. 0 means no limit.").Default("0").Int()
+	keepAlive              = kingpin.Flag("web.keep-alive", "Keep idle HTTP connections open for further requests.").Default("true").Bool()
+	idleTimeout            = kingpin.Flag("web.idle-timeout", "How long an idle keep-alive connection is kept open. 0 means no limit.").Default("0s").Duration()
+	compatInfluxQuery      = kingpin.Flag("compat.influx-query", "Answer /query with minimal InfluxDB responses, listing no databases for SHOW DATABASES, instead of an empty result.").Default("false").Bool()
+	summaryType            = kingpin.Flag("summary.type", "How --summary.quantile-field fields are exported. summary assembles a summary, gauge exports a gauge with a quantile label per field and leaves the count and sum fields alone.").Default("summary").Enum("summary", "gauge")
+	roundDigits            = kingpin.Flag("value.round-digits", "Round values to this many decimal digits. Rounding keeps counters monotonic, but increases smaller than the precision are lost until they add up. Negative means no rounding.").Default("-1").Int()
+	tagsetInfo             = kingpin.Flag("label.tagset-info", "Export the labels of each distinct label set once, on an influxdb_tagset_info metric with a tagset_id label, and only the tagset_id label on the samples.").Default("false").Bool()
+	strictParams           = kingpin.Flag("write.strict-params", "Reject writes with query parameters other than precision, db, rp, org, bucket and time.").Default("false").Bool()
+	timestampRound         = kingpin.Flag("timestamp.round", "Round timestamps of points to a multiple of this duration, for both export and deduplication. 0 keeps timestamps as they are.").Default("0s").Duration()
+	bareFields             = kingpin.Flag("name.bare-fields", "Field name whose metrics are named after just the measurement, without the field name. Can be repeated, replacing the default.").Default("value").Strings()
+	shutdownFlush          = kingpin.Flag("shutdown.flush", "On SIGTERM or SIGINT, push the stored samples to every --vm.import-url and --vm.route before exiting.").Default("false").Bool()
+	shutdownFlushTimeout   = kingpin.Flag("shutdown.flush-timeout", "How long --shutdown.flush waits for the pushes to finish.").Default("10s").Duration()
+	parseRatioWindow       = kingpin.Flag("write.parse-ratio-window", "Window over which influxdb_exporter_parse_success_ratio is computed. The ratio covers between one and two windows of writes.").Default("5m").Duration()
+	seriesHistory          = kingpin.Flag("series.history", "Number of most recent values kept per series for /-/series. 1 keeps only the current value.").Default("1").Int()
+	digitPrefix            = kingpin.Flag("name.digit-prefix", "Prefix added to metric and label names that start with a digit. Must be a valid label name itself.").Default("_").String()
+	integerFormat          = kingpin.Flag("value.integer-format", "How whole number values are written in text formats: shortest leaves the encoder output such as 5 and 1e+06, integer writes all digits such as 1000000, and decimal adds a fractional part such as 5.0.").Default("shortest").Enum("shortest", "integer", "decimal")
+	outputShards           = kingpin.Flag("output.shards", "Number of shards metric families are split into by a hash of their name. Scrapes with a shard query parameter between 0 and shards-1 only get the families of that shard.").Default("1").Int()
+	schemaFile             = kingpin.Flag("schema.file", "JSON file with the metric type and unit of fields, taking precedence over --field.type and --name.unit-normalize, see the README.").Default("").String()
+	omitHelp               = kingpin.Flag("export.omit-help", "Leave the help text out of metrics responses for smaller payloads.").Default("false").Bool()
+	vmBreakerThreshold     = kingpin.Flag("vm.breaker-threshold", "Consecutive failed VictoriaMetrics pushes after which pushes are skipped, dropping their samples, until a probe push succeeds. 0 disables the breaker.").Default("0").Int()
+	vmBreakerProbeInterval = kingpin.Flag("vm.breaker-probe-interval", "How often a push is tried while the --vm.breaker-threshold breaker is open.").Default("1m").Duration()
+	lastPush               = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "influxdb_last_push_timestamp_seconds",
 			Help: "Unix timestamp of the last received influxdb metrics push in seconds.",
@@ -61,15 +162,181 @@ var (
 			Help: "Current total udp parse errors.",
 		},
 	)
+	invalidNamePoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_invalid_name_points_total",
+			Help: "Total points rejected because of invalid names in strict name mode.",
+		},
+	)
+	measurementSamples = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "influxdb_exporter_measurement_samples",
+			Help: "Current number of distinct series stored per measurement.",
+		},
+		[]string{"measurement"},
+	)
+	measurementLastUpdate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "influxdb_exporter_measurement_last_update_seconds",
+			Help: "Unix timestamp of the last write received per measurement in seconds.",
+		},
+		[]string{"measurement"},
+	)
+	duplicateSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_duplicate_samples_total",
+			Help: "Total samples ignored because they were received within the deduplication window.",
+		},
+	)
+	graphiteDroppedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_graphite_dropped_samples_total",
+			Help: "Total samples that could not be forwarded to Graphite.",
+		},
+	)
+	labelLimitSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_label_limit_samples_total",
+			Help: "Total samples exceeding the label limit.",
+		},
+	)
+	encodeErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_exporter_encode_errors_total",
+			Help: "Total metric families that failed to encode while rendering metrics.",
+		},
+	)
+	untimestampedPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_untimestamped_points_total",
+			Help: "Total points skipped by --timestamp.require for lacking a timestamp.",
+		},
+	)
+	renderTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_render_timeouts_total",
+			Help: "Total scrapes aborted for exceeding --metrics.render-timeout.",
+		},
+	)
+	bytesIngested = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_exporter_bytes_ingested_total",
+			Help: "Total bytes of write request bodies received over HTTP, after decompression.",
+		},
+	)
+	vmPushFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_vm_push_failures_total",
+			Help: "Total batches that could not be pushed to VictoriaMetrics.",
+		},
+	)
+	vmBreakerDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_vm_breaker_dropped_samples_total",
+			Help: "Total samples not pushed to VictoriaMetrics because the --vm.breaker-threshold breaker was open.",
+		},
+	)
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "influxdb_exporter_http_requests_total",
+			Help: "Total HTTP requests by handler path and status code.",
+		},
+		[]string{"path", "code"},
+	)
+	outOfRangePoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_out_of_range_timestamp_points_total",
+			Help: "Total points dropped for a timestamp outside the supported time range.",
+		},
+	)
+	scrapeSamples = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "influxdb_exporter_scrape_samples",
+			Help: "Number of samples in the most recent metrics response.",
+		},
+	)
+	missingLabelSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_missing_required_label_samples_total",
+			Help: "Total samples dropped for lacking a --label.required label.",
+		},
+	)
+	parseRate = &pointsRate{
+		gauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "influxdb_exporter_parse_points_per_second",
+				Help: "Moving average of the number of points parsed per second of parse time by the write handler.",
+			},
+		),
+	}
+	parseSuccess = &parseRatio{
+		gauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "influxdb_exporter_parse_success_ratio",
+				Help: "Ratio of line protocol lines received over HTTP that parsed into points, over --write.parse-ratio-window.",
+			},
+		),
+	}
+	rejectedConnections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_exporter_rejected_connections_total",
+			Help: "Total number of HTTP connections closed for being over --web.max-connections.",
+		},
+	)
+	nameCollisionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_exporter_name_collisions_total",
+			Help: "Total raw names found to sanitize to the same metric name as a different raw name.",
+		},
+	)
+	cardinalityWarnings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_exporter_cardinality_warnings_total",
+			Help: "Total times a measurement exceeded --cardinality.warn-threshold distinct series.",
+		},
+	)
 	influxDbRegistry = prometheus.NewRegistry()
+
+	staleNaN = math.Float64frombits(staleNaNBits)
+
+	// Parsed from --name.unit-suffix, longest suffix first.
+	unitSuffixes []unitSuffix
+	// Parsed from --field.type.
+	fieldTypes = map[string]prometheus.ValueType{}
+	// Parsed from --field.expr.
+	fieldExprs = map[string]valueExpr{}
+	// Parsed from --summary.quantile-field.
+	summaryQuantiles = map[string]float64{}
+	// Parsed from --field.enum and --field.enum-default.
+	fieldEnums       = map[string]map[string]float64{}
+	fieldEnumUnknown *float64
 )
 
 type influxDBSample struct {
-	ID        string
-	Name      string
-	Labels    map[string]string
-	Value     float64
-	Timestamp time.Time
+	ID          string
+	Name        string
+	Measurement string
+	Labels      map[string]string
+	Value       float64
+	ValueType   prometheus.ValueType
+	Help        string
+	Timestamp   time.Time
+	// Set if the sample was assembled from quantile fields.
+	Summary *summaryValue
+}
+
+// summaryValue is a summary assembled from the fields of a point.
+type summaryValue struct {
+	count     uint64
+	sum       float64
+	quantiles map[float64]float64
+}
+
+// unitSuffix describes how a metric name suffix is normalized to a base unit.
+type unitSuffix struct {
+	suffix string
+	base   string
+	scale  float64
 }
 
 type errorResponse struct {
@@ -89,7 +356,7 @@ func (c *influxDBCollector) serveUdp() {
 		copy(bufCopy, buf[:n])
 
 		precision := "ns"
-		points, err := models.ParsePointsWithPrecision(bufCopy, time.Now().UTC(), precision)
+		points, err := c.parseBody(bufCopy, time.Now().UTC(), precision, 1)
 		if err != nil {
 			level.Error(c.logger).Log("msg", "Error parsing udp packet", "err", err)
 			udpParseErrors.Inc()
@@ -102,19 +369,56 @@ func (c *influxDBCollector) serveUdp() {
 
 type influxDBCollector struct {
 	samples map[string]*influxDBSample
-	mu      sync.Mutex
-	ch      chan *influxDBSample
-	logger  log.Logger
+	// Used instead of samples with --store.sample-id-hash.
+	hashed hashedSamples
+	// Number of samples per measurement, guarded by mu.
+	measurements map[string]int
+	mu           sync.Mutex
+	ch           chan *influxDBSample
+	logger       log.Logger
+	// Samples expired since the last scrape, guarded by mu.
+	expired []*influxDBSample
+	// Recently seen samples, only used from processSamples.
+	dedup *dedupCache
+	// Series per measurement, only used from processSamples.
+	cardinality *cardinalityTracker
+	// Sanitized names, nil if the cache is disabled.
+	names *nameCache
+	// Raw metric names by sanitized name.
+	collisions *nameCollisions
+	// Recent values by sample ID, guarded by mu. Nil unless
+	// --series.history is above 1.
+	history map[string][]historyPoint
 
 	// Udp
 	conn *net.UDPConn
+
+	// Optional forwarding of samples to Graphite.
+	graphite *graphiteForwarder
 }
 
 func newInfluxDBCollector(logger log.Logger) *influxDBCollector {
 	c := &influxDBCollector{
-		ch:      make(chan *influxDBSample),
-		samples: map[string]*influxDBSample{},
-		logger:  logger,
+		ch:           make(chan *influxDBSample),
+		samples:      map[string]*influxDBSample{},
+		measurements: map[string]int{},
+		logger:       logger,
+		collisions:   newNameCollisions(*nameCollisionsSize, logger),
+	}
+	if *dedupWindow > 0 {
+		c.dedup = newDedupCache(*dedupWindow, *dedupSize)
+	}
+	if *cardinalityThreshold > 0 {
+		c.cardinality = newCardinalityTracker(*cardinalityThreshold, *cardinalityWindow, logger)
+	}
+	if *sampleIDHash {
+		c.hashed = hashedSamples{}
+	}
+	if *nameCacheSize > 0 {
+		c.names = newNameCache(*nameCacheSize)
+	}
+	if *seriesHistory > 1 {
+		c.history = map[string][]historyPoint{}
 	}
 	go c.processSamples()
 	return c
@@ -125,18 +429,34 @@ func (c *influxDBCollector) influxDBPost(w http.ResponseWriter, r *http.Request)
 	lastPush.Set(float64(time.Now().UnixNano()) / 1e9)
 	var buf []byte
 
+	if *strictParams {
+		if param := unknownWriteParam(r.URL.Query()); param != "" {
+			http.Error(w, fmt.Sprintf("unknown query parameter %q", param), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if *dropInternal && r.URL.Query().Get("db") == "_internal" {
+		http.Error(w, "", http.StatusNoContent)
+		return
+	}
+
+	if *maxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(unwrapWriter(w), r.Body, *maxRequestSize)
+	}
+
 	ce := r.Header.Get("Content-Encoding")
 
 	if ce == "gzip" {
 		bufPointer := &buf
 		gunzip, err := gzip.NewReader(r.Body)
 		if err != nil {
-			JSONErrorResponse(w, fmt.Sprintf("error reading compressed body: %s", err), 500)
+			bodyErrorResponse(w, "error reading compressed body", err)
 			return
 		}
 		*bufPointer, err = ioutil.ReadAll(gunzip)
 		if err != nil {
-			JSONErrorResponse(w, fmt.Sprintf("error decompressing data: %s", err), 500)
+			bodyErrorResponse(w, "error decompressing data", err)
 			return
 		}
 	} else {
@@ -145,16 +465,45 @@ func (c *influxDBCollector) influxDBPost(w http.ResponseWriter, r *http.Request)
 		*bufPointer, err = ioutil.ReadAll(r.Body)
 
 		if err != nil {
-			JSONErrorResponse(w, fmt.Sprintf("error reading body: %s", err), 500)
+			bodyErrorResponse(w, "error reading body", err)
 			return
 		}
 	}
+	bytesIngested.Add(float64(len(buf)))
 
-	precision := "ns"
-	if r.FormValue("precision") != "" {
-		precision = r.FormValue("precision")
+	precision, err := requestPrecision(r)
+	if err != nil {
+		JSONErrorResponse(w, err.Error(), 400)
+		return
+	}
+	if precision == "auto" {
+		precision = guessPrecision(buf)
+	}
+	defaultTime, err := requestTime(r, time.Now().UTC(), precision)
+	if err != nil {
+		JSONErrorResponse(w, err.Error(), 400)
+		return
+	}
+	if *inputFormat == "ndjson" {
+		start := time.Now()
+		samples, err := c.parseNDJSON(buf, defaultTime, precision)
+		parseRate.observe(len(samples), time.Since(start))
+		parseSuccess.observe(len(splitLines(buf)), len(samples), start)
+		if err != nil {
+			JSONErrorResponse(w, fmt.Sprintf("error parsing request: %s", err), 400)
+			return
+		}
+		for _, s := range samples {
+			c.ch <- s
+		}
+		http.Error(w, "", http.StatusNoContent)
+		return
 	}
-	points, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), precision)
+
+	start := time.Now()
+	points, err := c.parseBody(buf, defaultTime, precision, *parseWorkers)
+	parseRate.observe(len(points), time.Since(start))
+	parseSuccess.observe(len(splitLines(buf)), len(points), start)
 	if err != nil {
 		JSONErrorResponse(w, fmt.Sprintf("error parsing request: %s", err), 400)
 		return
@@ -166,122 +515,698 @@ func (c *influxDBCollector) influxDBPost(w http.ResponseWriter, r *http.Request)
 	http.Error(w, "", http.StatusNoContent)
 }
 
+// dump writes all stored samples as line protocol, with the sample value in
+// the "value" field. Names are the sanitized metric names, and tag values
+// ending in a backslash cannot be represented in line protocol.
+func (c *influxDBCollector) dump(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	samples := c.storedSamples()
+	c.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return sampleKey(samples[i]) < sampleKey(samples[j]) })
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, s := range samples {
+		// NewPoint takes care of escaping names, tags and fields.
+		p, err := models.NewPoint(s.Name, models.NewTags(s.Labels), models.Fields{"value": s.Value}, s.Timestamp)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Failed to dump sample", "id", sampleKey(s), "err", err)
+			continue
+		}
+		fmt.Fprintln(w, p.String())
+	}
+}
+
+// bodyErrorResponse writes the response for an error reading a request body.
+// Bodies cut off by http.MaxBytesReader are rejected with 413.
+func bodyErrorResponse(w http.ResponseWriter, msg string, err error) {
+	// http.MaxBytesReader does not return a distinct error type before Go 1.19.
+	if err.Error() == "http: request body too large" {
+		JSONErrorResponse(w, fmt.Sprintf("%s: %s", msg, err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	JSONErrorResponse(w, fmt.Sprintf("%s: %s", msg, err), 500)
+}
+
+// requestPrecision returns the timestamp precision of a write request. The
+// X-Influx-Precision header takes priority over the precision query parameter.
+func requestPrecision(r *http.Request) (string, error) {
+	precision := r.Header.Get("X-Influx-Precision")
+	if precision == "" {
+		precision = r.FormValue("precision")
+	}
+	if precision == "" {
+		return "ns", nil
+	}
+	if precision == "auto" {
+		return precision, nil
+	}
+	return parsePrecision(precision)
+}
+
+// requestTime returns the timestamp of points without one in a write request.
+// The time query parameter can set it for backfills, as RFC 3339 or as a Unix
+// timestamp in the precision of the request. It defaults to now.
+func requestTime(r *http.Request, now time.Time, precision string) (time.Time, error) {
+	v := r.URL.Query().Get("time")
+	if v == "" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t.UTC(), nil
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339 or a Unix timestamp", v)
+	}
+	t, err := models.SafeCalcTime(ts, precision)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %s", v, err)
+	}
+	return t.UTC(), nil
+}
+
+// parsePrecision validates a timestamp precision, normalizing it to the form
+// understood by models.ParsePointsWithPrecision.
+func parsePrecision(precision string) (string, error) {
+	switch precision {
+	case "n", "ns", "u", "ms", "s", "m", "h":
+		return precision, nil
+	case "us":
+		return "u", nil
+	}
+	return "", fmt.Errorf("invalid precision %q", precision)
+}
+
+// parsePoints parses line protocol with the given precision, except for
+// measurements with a precision override.
+//
+// ParsePointsWithPrecision applies one precision to the whole buffer, so when
+// overrides are configured the lines are grouped by precision first and each
+// group is parsed separately. Points of a series share a measurement and thus
+// a group, so their relative order is preserved.
+func parsePoints(buf []byte, defaultTime time.Time, precision string) ([]models.Point, error) {
+	if len(*measurementPrecision) == 0 {
+		return models.ParsePointsWithPrecision(buf, defaultTime, precision)
+	}
+
+	groups := map[string][]byte{}
+	for _, line := range splitLines(buf) {
+		p := precision
+		if override, ok := (*measurementPrecision)[string(models.ParseName(line))]; ok {
+			p = override
+		}
+		groups[p] = append(append(groups[p], line...), '\n')
+	}
+
+	var (
+		points []models.Point
+		failed []string
+	)
+	for p, group := range groups {
+		pts, err := models.ParsePointsWithPrecision(group, defaultTime, p)
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+		points = append(points, pts...)
+	}
+	if len(failed) > 0 {
+		return points, fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return points, nil
+}
+
+// parsePointsParallel parses buf like parsePoints, splitting it into one
+// chunk of contiguous lines per worker. Points are returned in chunk order so
+// that later points for a series still overwrite earlier ones.
+func parsePointsParallel(buf []byte, defaultTime time.Time, precision string, workers int) ([]models.Point, error) {
+	if workers <= 1 {
+		return parsePoints(buf, defaultTime, precision)
+	}
+	lines := splitLines(buf)
+	if len(lines) < workers {
+		return parsePoints(buf, defaultTime, precision)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		points = make([][]models.Point, workers)
+		errs   = make([]error, workers)
+		size   = (len(lines) + workers - 1) / workers
+	)
+	for i := 0; i < workers; i++ {
+		start, end := i*size, (i+1)*size
+		if start >= len(lines) {
+			break
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+		wg.Add(1)
+		go func(i int, chunk [][]byte) {
+			defer wg.Done()
+			points[i], errs[i] = parsePoints(bytes.Join(chunk, []byte{'\n'}), defaultTime, precision)
+		}(i, lines[start:end])
+	}
+	wg.Wait()
+
+	var (
+		merged []models.Point
+		failed []string
+	)
+	for i := range points {
+		merged = append(merged, points[i]...)
+		if errs[i] != nil {
+			failed = append(failed, errs[i].Error())
+		}
+	}
+	if len(failed) > 0 {
+		return merged, fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return merged, nil
+}
+
+// pointsRate is an exponentially weighted moving average of parse throughput.
+type pointsRate struct {
+	mu    sync.Mutex
+	rate  float64
+	gauge prometheus.Gauge
+}
+
+// pointsRateWeight is the weight of each observation in the moving average.
+const pointsRateWeight = 0.2
+
+// observe records that n points were parsed in d.
+func (r *pointsRate) observe(n int, d time.Duration) {
+	if n == 0 || d <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rate := float64(n) / d.Seconds()
+	if r.rate == 0 {
+		r.rate = rate
+	} else {
+		r.rate = pointsRateWeight*rate + (1-pointsRateWeight)*r.rate
+	}
+	r.gauge.Set(r.rate)
+}
+
+// writeParams are the query parameters of the InfluxDB 1.x and 2.x write
+// endpoints, and the time parameter of this exporter.
+var writeParams = map[string]bool{"precision": true, "db": true, "rp": true, "org": true, "bucket": true, "time": true}
+
+// unknownWriteParam returns the first query parameter, in sorted order, that
+// is not in writeParams, or "" if there is none.
+func unknownWriteParam(query url.Values) string {
+	var unknown []string
+	for param := range query {
+		if !writeParams[param] {
+			unknown = append(unknown, param)
+		}
+	}
+	if len(unknown) == 0 {
+		return ""
+	}
+	sort.Strings(unknown)
+	return unknown[0]
+}
+
+// parseRatio tracks the ratio of parsed points to received lines. Counts are
+// kept for the current and the previous window, so the ratio covers between
+// one and two windows.
+type parseRatio struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	attempted, parsed         int
+	prevAttempted, prevParsed int
+	gauge                     prometheus.Gauge
+}
+
+// observe records that parsed of attempted lines were parsed at now.
+func (r *parseRatio) observe(attempted, parsed int, now time.Time) {
+	if attempted == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.start) >= *parseRatioWindow {
+		// Counts older than the previous window are dropped entirely.
+		if now.Sub(r.start) >= 2**parseRatioWindow {
+			r.attempted, r.parsed = 0, 0
+		}
+		r.prevAttempted, r.prevParsed = r.attempted, r.parsed
+		r.attempted, r.parsed = 0, 0
+		r.start = now
+	}
+	r.attempted += attempted
+	r.parsed += parsed
+	r.gauge.Set(float64(r.parsed+r.prevParsed) / float64(r.attempted+r.prevAttempted))
+}
+
+// parseBody parses a write with parsePointsParallel. With --timestamp.require,
+// lines without a timestamp are skipped. Lines with timestamps that don't fit
+// into the supported time range would fail the whole write, so if parsing
+// fails they are dropped and the rest is parsed again.
+func (c *influxDBCollector) parseBody(buf []byte, defaultTime time.Time, precision string, workers int) ([]models.Point, error) {
+	if *requireTimestamp {
+		var skipped int
+		buf, skipped = timestampedLines(buf)
+		untimestampedPoints.Add(float64(skipped))
+	}
+	points, err := parsePointsParallel(buf, defaultTime, precision, workers)
+	if err == nil {
+		return points, nil
+	}
+	filtered, dropped := c.dropOutOfRange(buf, precision)
+	if dropped == 0 {
+		return points, err
+	}
+	return parsePointsParallel(filtered, defaultTime, precision, workers)
+}
+
+// dropOutOfRange removes lines whose timestamp is outside the range
+// InfluxDB supports, returning the remaining lines and the number dropped.
+func (c *influxDBCollector) dropOutOfRange(buf []byte, precision string) ([]byte, int) {
+	var (
+		out     []byte
+		dropped int
+	)
+	for _, line := range splitLines(buf) {
+		if _, _, timestamp := lineSections(line); len(timestamp) > 0 {
+			p := precision
+			if override, ok := (*measurementPrecision)[string(models.ParseName(line))]; ok {
+				p = override
+			}
+			ts, err := strconv.ParseInt(string(timestamp), 10, 64)
+			if err == nil {
+				_, err = models.SafeCalcTime(ts, p)
+			}
+			if err != nil && (err == models.ErrTimeOutOfRange || errors.Is(err, strconv.ErrRange)) {
+				level.Warn(c.logger).Log("msg", "Dropping point with out of range timestamp", "timestamp", timestamp, "err", err)
+				outOfRangePoints.Inc()
+				dropped++
+				continue
+			}
+		}
+		out = append(append(out, line...), '\n')
+	}
+	return out, dropped
+}
+
 func (c *influxDBCollector) parsePointsToSample(points []models.Point) {
+	now := float64(time.Now().UnixNano()) / 1e9
+	updated := map[string]bool{}
+	for _, s := range points {
+		if !updated[string(s.Name())] {
+			updated[string(s.Name())] = true
+			measurementLastUpdate.WithLabelValues(string(s.Name())).Set(now)
+		}
+	}
+
 	for _, s := range points {
 		fields, err := s.Fields()
 		if err != nil {
 			level.Error(c.logger).Log("msg", "error getting fields from point", "err", err)
 			continue
 		}
+		if *strictNames {
+			if invalid := invalidPointName(s, fields); invalid != "" {
+				level.Warn(c.logger).Log("msg", "rejecting point with invalid name", "name", invalid)
+				invalidNamePoints.Inc()
+				continue
+			}
+		}
+		// Prometheus metrics written to InfluxDB carry their original name
+		// in the __name__ tag, which takes precedence over the measurement.
+		measurement := string(s.Name())
+		if trimmed := strings.TrimPrefix(measurement, *trimPrefix); trimmed != "" {
+			measurement = trimmed
+		}
+		if n := s.Tags().GetString("__name__"); n != "" {
+			measurement = n
+		}
+		for _, field := range *flattenJSONFields {
+			c.flattenJSONField(fields, field)
+		}
+		if len(summaryQuantiles) > 0 {
+			if err := extractSummary(fields, *summaryType == "summary"); err != nil {
+				level.Warn(c.logger).Log("msg", "Not assembling summary", "measurement", string(s.Name()), "err", err)
+			}
+		}
 		for field, v := range fields {
-			var value float64
+			if *dropInternal && strings.HasPrefix(field, "_") {
+				continue
+			}
+			if (len(*fieldKeep) > 0 && !matchAny(*fieldKeep, field)) || matchAny(*fieldDrop, field) {
+				continue
+			}
+			var (
+				value     float64
+				valueType string
+			)
 			switch v := v.(type) {
+			case *summaryValue:
+				value = v.sum
 			case float64:
-				value = v
+				value, valueType = v, "float"
 			case int64:
-				value = float64(v)
+				value, valueType = float64(v), "int"
+			case uint64:
+				value, valueType = float64(v), "uint"
 			case bool:
 				if v {
 					value = 1
 				} else {
 					value = 0
 				}
+				valueType = "bool"
+			case string:
+				var ok bool
+				if value, ok = enumValue(field, v); !ok {
+					continue
+				}
+				valueType = "string"
 			default:
 				continue
 			}
+			if e, ok := fieldExprs[field]; ok {
+				value = e.eval(value)
+			}
+			if *roundDigits >= 0 {
+				value = roundValue(value, *roundDigits)
+			}
 
+			nameField := field
+			if trimmed := strings.TrimSuffix(field, *trimFieldSuffix); trimmed != "" {
+				nameField = trimmed
+			}
 			var name string
-			if field == "value" {
-				name = string(s.Name())
+			if *nameAsLabels {
+				name = *nameAsLabelsMetric
+			} else if isBareField(nameField) {
+				name = measurement
 			} else {
-				name = string(s.Name()) + "_" + field
+				name = measurement + "_" + nameField
 			}
 
-			ReplaceInvalidChars(&name)
+			name = c.metricName(name)
+			fs, inSchema := schema[schemaKey{string(s.Name()), field}]
+			if inSchema && fs.unit != "" && !*nameAsLabels {
+				name = addSchemaUnit(name, fs.unit)
+				setMetricUnit(name, fs.unit)
+			} else if *unitNormalize && !*nameAsLabels {
+				var unit string
+				if name, value, unit = normalizeUnit(name, value); unit != "" {
+					setMetricUnit(name, unit)
+				}
+			}
 			sample := &influxDBSample{
-				Name:      name,
-				Timestamp: s.Time(),
-				Value:     value,
-				Labels:    map[string]string{},
+				Name:        name,
+				Measurement: string(s.Name()),
+				Timestamp:   roundTimestamp(s.Time().UTC()),
+				Value:       value,
+				ValueType:   prometheus.UntypedValue,
+				Labels:      map[string]string{},
+			}
+			if t, ok := fieldTypes[field]; ok {
+				sample.ValueType = t
+			}
+			if inSchema && fs.valueType != nil {
+				sample.ValueType = *fs.valueType
+			}
+			if summary, ok := v.(*summaryValue); ok {
+				sample.Summary = summary
+			}
+			// Telegraf can describe a field in a <field>_help string field.
+			if help, ok := fields[field+"_help"].(string); ok {
+				sample.Help = help
 			}
 			for _, v := range s.Tags() {
-				key := string(v.Key)
-				if key == "__name__" {
-					continue
+				if key := string(v.Key); key != "__name__" {
+					c.addLabel(sample.Labels, key, string(v.Value))
 				}
-				ReplaceInvalidChars(&key)
-				sample.Labels[key] = string(v.Value)
 			}
-
-			// Calculate a consistent unique ID for the sample.
-			labelnames := make([]string, 0, len(sample.Labels))
-			for k := range sample.Labels {
-				labelnames = append(labelnames, k)
+			if *labelValueType && valueType != "" {
+				sample.Labels["value_type"] = valueType
+			}
+			// The name labels are added after the cap, as truncating them
+			// would merge series of different measurements.
+			if !limitLabels(sample.Labels) {
+				continue
 			}
-			sort.Strings(labelnames)
-			parts := make([]string, 0, len(sample.Labels)*2+1)
-			parts = append(parts, name)
-			for _, l := range labelnames {
-				parts = append(parts, l, sample.Labels[l])
+			// The measurement as used in metric names, after trimming.
+			if *nameAsLabels {
+				sample.Labels["measurement"] = measurement
+				sample.Labels["field"] = field
+			} else if *nameDual {
+				sample.Labels["measurement"] = measurement
 			}
-			sample.ID = strings.Join(parts, ".")
 
+			if sample.Summary != nil && *summaryType == "gauge" {
+				for _, q := range quantileGauges(sample) {
+					c.ch <- q
+				}
+				continue
+			}
+
+			sample.ID = sampleID(name, sample.Labels)
 			c.ch <- sample
 		}
 	}
 }
 
+// quantileGauges splits a summary sample into a gauge sample per quantile,
+// with the quantile as a label.
+func quantileGauges(s *influxDBSample) []*influxDBSample {
+	quantiles := make([]float64, 0, len(s.Summary.quantiles))
+	for q := range s.Summary.quantiles {
+		quantiles = append(quantiles, q)
+	}
+	sort.Float64s(quantiles)
+
+	gauges := make([]*influxDBSample, 0, len(quantiles))
+	for _, q := range quantiles {
+		g := *s
+		g.Summary = nil
+		g.Value = s.Summary.quantiles[q]
+		g.ValueType = prometheus.GaugeValue
+		g.Labels = make(map[string]string, len(s.Labels)+1)
+		for k, v := range s.Labels {
+			g.Labels[k] = v
+		}
+		g.Labels["quantile"] = strconv.FormatFloat(q, 'f', -1, 64)
+		g.ID = sampleID(g.Name, g.Labels)
+		gauges = append(gauges, &g)
+	}
+	return gauges
+}
+
+// idEscaper escapes the ID separator in label values. Metric and label names
+// are sanitized and never contain it.
+var idEscaper = strings.NewReplacer(`\`, `\\`, ".", `\.`)
+
+// sampleID calculates a consistent unique ID for a sample, joining the name
+// and the labels sorted by label name with dots.
+func sampleID(name string, labels map[string]string) string {
+	labelnames := make([]string, 0, len(labels))
+	for k := range labels {
+		labelnames = append(labelnames, k)
+	}
+	sort.Strings(labelnames)
+	parts := make([]string, 0, len(labels)*2+1)
+	parts = append(parts, name)
+	for _, l := range labelnames {
+		parts = append(parts, l, idEscaper.Replace(labels[l]))
+	}
+	return strings.Join(parts, ".")
+}
+
 func (c *influxDBCollector) processSamples() {
 	ticker := time.NewTicker(time.Minute).C
 	for {
 		select {
 		case s := <-c.ch:
+			if c.dedup != nil && c.dedup.seen(s, time.Now()) {
+				duplicateSamples.Inc()
+				continue
+			}
+			if c.cardinality != nil {
+				c.cardinality.observe(s, time.Now())
+			}
 			c.mu.Lock()
-			c.samples[s.ID] = s
+			if c.history != nil {
+				c.recordHistory(s)
+			}
+			if old := c.putSample(s); old != nil {
+				c.countMeasurement(old.Measurement, -1)
+			}
+			c.countMeasurement(s.Measurement, 1)
 			c.mu.Unlock()
+			if c.graphite != nil {
+				c.graphite.forward(s)
+			}
 
 		case <-ticker:
-			// Garbage collect expired value lists.
-			ageLimit := time.Now().Add(-*sampleExpiry)
-			c.mu.Lock()
-			for k, sample := range c.samples {
-				if ageLimit.After(sample.Timestamp) {
-					delete(c.samples, k)
-				}
-			}
-			c.mu.Unlock()
+			c.expireSamples(time.Now().Add(-*sampleExpiry))
 		}
 	}
 }
 
-// Collect implements prometheus.Collector.
-func (c *influxDBCollector) Collect(ch chan<- prometheus.Metric) {
-	ch <- lastPush
-
+// expireSamples garbage collects samples older than ageLimit.
+func (c *influxDBCollector) expireSamples(ageLimit time.Time) {
 	c.mu.Lock()
-	samples := make([]*influxDBSample, 0, len(c.samples))
-	for _, sample := range c.samples {
-		samples = append(samples, sample)
-	}
-	c.mu.Unlock()
-
-	ageLimit := time.Now().Add(-*sampleExpiry)
+	defer c.mu.Unlock()
+	for _, sample := range c.storedSamples() {
+		if ageLimit.After(sample.Timestamp) {
+			c.countMeasurement(sample.Measurement, -1)
+			if _, ok := c.measurements[sample.Measurement]; !ok {
+				measurementLastUpdate.DeleteLabelValues(sample.Measurement)
+			}
+			c.removeSample(sample)
+			if *staleMarkers {
+				c.expired = append(c.expired, sample)
+			}
+		}
+	}
+}
+
+// countMeasurement adjusts the number of samples stored for a measurement.
+// It must be called with mu held.
+func (c *influxDBCollector) countMeasurement(measurement string, delta int) {
+	n := c.measurements[measurement] + delta
+	if n <= 0 {
+		delete(c.measurements, measurement)
+		measurementSamples.DeleteLabelValues(measurement)
+		return
+	}
+	c.measurements[measurement] = n
+	measurementSamples.WithLabelValues(measurement).Set(float64(n))
+}
+
+// Collect implements prometheus.Collector.
+func (c *influxDBCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- lastPush
+	if *emitUp {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(*upName, "Whether the InfluxDB exporter is up.", nil, nil),
+			prometheus.GaugeValue,
+			1,
+		)
+	}
+
+	c.mu.Lock()
+	samples := c.storedSamples()
+	var expired []*influxDBSample
+	for _, sample := range c.expired {
+		// Series that came back since do not get a marker.
+		if !c.hasSample(sample) {
+			expired = append(expired, sample)
+		}
+	}
+	c.expired = nil
+	c.mu.Unlock()
+
+	collectSamples(ch, samples, expired)
+}
+
+// defaultHelp is the help text of metrics without a _help field.
+const defaultHelp = "InfluxDB Metric"
+
+// familyHelps returns the help text of each metric name that has one. All
+// samples of a family must share a help text, so if they disagree the
+// lexically first one is used.
+func familyHelps(lists ...[]*influxDBSample) map[string]string {
+	helps := map[string]string{}
+	for _, samples := range lists {
+		for _, sample := range samples {
+			if sample.Help == "" {
+				continue
+			}
+			if h, ok := helps[sample.Name]; !ok || sample.Help < h {
+				helps[sample.Name] = sample.Help
+			}
+		}
+	}
+	return helps
+}
+
+// collectSamples sends staleness markers for the expired samples and the
+// unexpired samples as metrics.
+func collectSamples(ch chan<- prometheus.Metric, samples, expired []*influxDBSample) {
+	helps := familyHelps(samples, expired)
+	help := func(name string) string {
+		if h, ok := helps[name]; ok {
+			return h
+		}
+		return defaultHelp
+	}
+
+	var infos map[string]map[string]string
+	labels := func(s *influxDBSample) map[string]string { return s.Labels }
+	if *tagsetInfo {
+		infos = map[string]map[string]string{}
+		labels = func(s *influxDBSample) map[string]string {
+			if len(s.Labels) == 0 {
+				return s.Labels
+			}
+			id := tagsetID(s.Labels)
+			infos[id] = s.Labels
+			return map[string]string{tagsetIDLabel: id}
+		}
+	}
+
+	for _, sample := range expired {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(sample.Name, help(sample.Name), []string{}, labels(sample)),
+			sample.ValueType,
+			staleNaN,
+		)
+	}
+
+	now := time.Now()
+	ageLimit := now.Add(-*sampleExpiry)
+	timestampLimit := now.Add(-*timestampMaxAge)
 	for _, sample := range samples {
 		if ageLimit.After(sample.Timestamp) {
 			continue
 		}
 
-		metric := prometheus.MustNewConstMetric(
-			prometheus.NewDesc(sample.Name, "InfluxDB Metric", []string{}, sample.Labels),
-			prometheus.UntypedValue,
-			sample.Value,
-		)
+		desc := prometheus.NewDesc(sample.Name, help(sample.Name), []string{}, labels(sample))
+		var metric prometheus.Metric
+		if sample.Summary != nil {
+			metric = prometheus.MustNewConstSummary(desc, sample.Summary.count, sample.Summary.sum, sample.Summary.quantiles)
+		} else {
+			metric = prometheus.MustNewConstMetric(desc, sample.ValueType, sample.Value)
+		}
 
-		if *exportTimestamp {
-			metric = prometheus.NewMetricWithTimestamp(sample.Timestamp, metric)
+		if *exportTimestamp && (*timestampMaxAge == 0 || !timestampLimit.After(sample.Timestamp)) && !matchAny(*timestampSkip, sample.Measurement) {
+			metric = prometheus.NewMetricWithTimestamp(sample.Timestamp.UTC(), metric)
 		}
 		ch <- metric
 	}
+
+	for id, l := range infos {
+		info := make(map[string]string, len(l)+1)
+		for k, v := range l {
+			info[k] = v
+		}
+		info[tagsetIDLabel] = id
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(tagsetInfoName, "Labels of the samples referencing a tagset_id.", nil, info),
+			prometheus.GaugeValue,
+			1,
+		)
+	}
+}
+
+const (
+	tagsetInfoName = "influxdb_tagset_info"
+	tagsetIDLabel  = "tagset_id"
+)
+
+// tagsetID returns a stable ID for a label set.
+func tagsetID(labels map[string]string) string {
+	return fmt.Sprintf("%016x", seriesHash("", labels))
 }
 
 // Describe implements prometheus.Collector.
@@ -289,6 +1214,64 @@ func (c *influxDBCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- lastPush.Desc()
 }
 
+// metricName sanitizes a metric name and prepends the namespace and
+// subsystem.
+func (c *influxDBCollector) metricName(name string) string {
+	sanitized := c.sanitizeName(name)
+	c.collisions.check(name, sanitized)
+	return prometheus.BuildFQName(*nameNamespace, *nameSubsystem, sanitized)
+}
+
+// addLabel sanitizes a tag and adds it to labels, unless the label flags
+// drop it.
+func (c *influxDBCollector) addLabel(labels map[string]string, key, value string) {
+	key = c.sanitizeName(key)
+	if strings.HasPrefix(key, "__") {
+		if *reservedLabelPolicy == "drop" {
+			return
+		}
+		key = "key_" + key
+	}
+	if *dropEmptyLabels && emptyLabelValue(value) {
+		return
+	}
+	if *sanitizeValues {
+		value = sanitizeLabelValue(value)
+	}
+	if *replaceDots {
+		value = strings.Replace(value, ".", *replaceDotsWith, -1)
+	}
+	labels[key] = value
+}
+
+// limitLabels applies --label.rename, --label.required and --label.max-count
+// to the labels of a sample. It returns false if the sample is dropped.
+func limitLabels(labels map[string]string) bool {
+	renameLabels(labels, *labelRename)
+	if missingRequiredLabel(labels) {
+		missingLabelSamples.Inc()
+		return false
+	}
+	if *maxLabels > 0 && len(labels) > *maxLabels {
+		labelLimitSamples.Inc()
+		if *maxLabelsAction == "drop" {
+			return false
+		}
+		truncateLabels(labels, *maxLabels)
+	}
+	return true
+}
+
+// sanitizeName replaces invalid characters in a metric or label name, using
+// the name cache if enabled.
+func (c *influxDBCollector) sanitizeName(name string) string {
+	if c.names != nil {
+		return c.names.sanitize(name)
+	}
+	ReplaceInvalidChars(&name)
+	return name
+}
+
 // analog of invalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
 func ReplaceInvalidChars(in *string) {
 
@@ -302,13 +1285,321 @@ func ReplaceInvalidChars(in *string) {
 			*in = (*in)[:charIndex] + "_" + (*in)[charIndex+1:]
 		}
 	}
-	// prefix with _ if first char is 0-9
+	// prefix with --name.digit-prefix if first char is 0-9
 	if int((*in)[0]) >= 48 && int((*in)[0]) <= 57 {
-		*in = "_" + *in
+		*in = *digitPrefix + *in
+	}
+}
+
+// extractSummary replaces the fields configured with --summary.quantile-field,
+// and the count and sum fields if countSum is set, with a "value" field
+// holding a summary. Fields are left untouched if none of the quantile fields
+// are present, and with an error if there already is a value field.
+func extractSummary(fields models.Fields, countSum bool) error {
+	var present bool
+	for field := range summaryQuantiles {
+		if _, ok := numericField(fields[field]); ok {
+			present = true
+			break
+		}
+	}
+	if !present {
+		return nil
+	}
+	if _, ok := fields["value"]; ok {
+		return errors.New("value field would be replaced by the summary")
+	}
+
+	summary := &summaryValue{quantiles: map[float64]float64{}}
+	for field, q := range summaryQuantiles {
+		if v, ok := numericField(fields[field]); ok {
+			summary.quantiles[q] = v
+			delete(fields, field)
+		}
+	}
+	fields["value"] = summary
+	if !countSum {
+		return nil
+	}
+	if v, ok := numericField(fields["count"]); ok {
+		summary.count = uint64(v)
+		delete(fields, "count")
+	}
+	if v, ok := numericField(fields["sum"]); ok {
+		summary.sum = v
+		delete(fields, "sum")
+	}
+	return nil
+}
+
+// flattenJSONField replaces a string field holding a JSON object with a field
+// per numeric leaf, named after the path to it. Other leaves are ignored, as
+// are blobs over maxFlattenBytes and anything nested deeper than
+// maxFlattenDepth.
+func (c *influxDBCollector) flattenJSONField(fields models.Fields, field string) {
+	blob, ok := fields[field].(string)
+	if !ok {
+		return
+	}
+	delete(fields, field)
+	if len(blob) > maxFlattenBytes {
+		level.Warn(c.logger).Log("msg", "Ignoring oversized JSON field", "field", field, "size", len(blob))
+		return
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(blob), &v); err != nil {
+		level.Warn(c.logger).Log("msg", "Ignoring invalid JSON field", "field", field, "err", err)
+		return
+	}
+	flattenJSON(fields, field, v, 0)
+}
+
+func flattenJSON(fields models.Fields, prefix string, v interface{}, depth int) {
+	switch v := v.(type) {
+	case float64:
+		if _, ok := fields[prefix]; !ok {
+			fields[prefix] = v
+		}
+	case map[string]interface{}:
+		if depth == maxFlattenDepth {
+			return
+		}
+		for k, child := range v {
+			flattenJSON(fields, prefix+"_"+k, child, depth+1)
+		}
+	}
+}
+
+// emptyLabelValue reports whether a label value is empty or NaN.
+func emptyLabelValue(v string) bool {
+	return v == "" || v == "NaN"
+}
+
+// missingRequiredLabel reports whether any --label.required label is missing
+// or empty.
+func missingRequiredLabel(labels map[string]string) bool {
+	for _, l := range *requiredLabels {
+		if labels[l] == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isBareField reports whether metrics of a field are named after just the
+// measurement, see --name.bare-fields.
+func isBareField(field string) bool {
+	for _, f := range *bareFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// roundTimestamp rounds t to a multiple of --timestamp.round. Samples get
+// their timestamp rounded before they are deduplicated, so points of a series
+// that are closer to each other than the rounding are duplicates.
+func roundTimestamp(t time.Time) time.Time {
+	if *timestampRound > 0 {
+		return t.Round(*timestampRound)
+	}
+	return t
+}
+
+// roundValue rounds v to the given number of decimal digits. Values too
+// large to scale are already precise enough and returned as is.
+func roundValue(v float64, digits int) float64 {
+	scale := math.Pow10(digits)
+	if r := math.Round(v*scale) / scale; !math.IsInf(r, 0) && !math.IsNaN(r) {
+		return r
+	}
+	return v
+}
+
+// enumValue returns the number a string field value is mapped to by
+// --field.enum, and false if the field is not an enum or the value should be
+// dropped.
+func enumValue(field, v string) (float64, bool) {
+	values, ok := fieldEnums[field]
+	if !ok {
+		return 0, false
+	}
+	if n, ok := values[v]; ok {
+		return n, true
+	}
+	if fieldEnumUnknown != nil {
+		return *fieldEnumUnknown, true
+	}
+	return 0, false
+}
+
+// parseEnum parses a --field.enum mapping such as running=1,stopped=0.
+func parseEnum(mapping string) (map[string]float64, error) {
+	values := map[string]float64{}
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected value=number, got %q", pair)
+		}
+		n, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		values[parts[0]] = n
+	}
+	return values, nil
+}
+
+// numericField returns the value of a float or integer field.
+func numericField(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// parseValueType parses the name of a metric type.
+func parseValueType(s string) (prometheus.ValueType, error) {
+	switch s {
+	case "counter":
+		return prometheus.CounterValue, nil
+	case "gauge":
+		return prometheus.GaugeValue, nil
+	case "untyped":
+		return prometheus.UntypedValue, nil
+	}
+	return 0, fmt.Errorf("invalid metric type %q", s)
+}
+
+// parseUnitSuffixes parses suffix=base:scale unit definitions.
+func parseUnitSuffixes(defs map[string]string) ([]unitSuffix, error) {
+	units := make([]unitSuffix, 0, len(defs))
+	for suffix, def := range defs {
+		i := strings.LastIndex(def, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("unit suffix %q: expected base:scale, got %q", suffix, def)
+		}
+		scale, err := strconv.ParseFloat(def[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unit suffix %q: invalid scale: %s", suffix, err)
+		}
+		units = append(units, unitSuffix{suffix: "_" + suffix, base: "_" + def[:i], scale: scale})
+	}
+	sort.Slice(units, func(i, j int) bool {
+		if len(units[i].suffix) != len(units[j].suffix) {
+			return len(units[i].suffix) > len(units[j].suffix)
+		}
+		return units[i].suffix < units[j].suffix
+	})
+	return units, nil
+}
+
+// normalizeUnit replaces a known unit suffix of name with its base unit and
+// scales the value accordingly. It also returns the base unit, or "" if name
+// has no known unit suffix.
+func normalizeUnit(name string, value float64) (string, float64, string) {
+	for _, u := range unitSuffixes {
+		if strings.HasSuffix(name, u.suffix) {
+			return strings.TrimSuffix(name, u.suffix) + u.base, value * u.scale, strings.TrimPrefix(u.base, "_")
+		}
+	}
+	return name, value, ""
+}
+
+// matchAny reports whether s matches any of the glob patterns.
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// renameLabels applies renames to labels. Every rename reads the original
+// labels, so chained rules like a=b,b=c do not depend on map order. A label
+// that already exists is kept, and of several labels renamed to the same name
+// the one with the lowest original name wins.
+func renameLabels(labels map[string]string, renames map[string]string) {
+	var from []string
+	values := map[string]string{}
+	for k := range renames {
+		if v, ok := labels[k]; ok {
+			from = append(from, k)
+			values[k] = v
+		}
+	}
+	sort.Strings(from)
+	for _, k := range from {
+		delete(labels, k)
+	}
+	for _, k := range from {
+		if _, ok := labels[renames[k]]; !ok {
+			labels[renames[k]] = values[k]
+		}
+	}
+}
+
+// truncateLabels removes all but the n labels with the lowest names.
+func truncateLabels(labels map[string]string, n int) {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names[n:] {
+		delete(labels, k)
+	}
+}
+
+// sanitizeLabelValue replaces control characters in a label value with
+// underscores, leaving other UTF-8 intact.
+func sanitizeLabelValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// invalidPointName returns the first measurement, field or tag key name of the
+// point that ReplaceInvalidChars would modify, or "" if all names are valid.
+func invalidPointName(p models.Point, fields models.Fields) string {
+	names := make([]string, 0, len(fields)+len(p.Tags())+1)
+	names = append(names, string(p.Name()))
+	for field := range fields {
+		names = append(names, field)
+	}
+	for _, t := range p.Tags() {
+		if string(t.Key) == "__name__" {
+			continue
+		}
+		names = append(names, string(t.Key))
+	}
+	return invalidName(names)
+}
+
+// invalidName returns the first of names that ReplaceInvalidChars would
+// modify, or "" if all names are valid.
+func invalidName(names []string) string {
+	for _, name := range names {
+		sanitized := name
+		ReplaceInvalidChars(&sanitized)
+		if sanitized != name {
+			return name
+		}
 	}
+	return ""
 }
 
-//JSONErrorResponse write error in json fromat and set response code
+// JSONErrorResponse write error in json fromat and set response code
 func JSONErrorResponse(w http.ResponseWriter, err string, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -318,9 +1609,133 @@ func JSONErrorResponse(w http.ResponseWriter, err string, code int) {
 	})
 }
 
+// influxQueryResult is a statement result of the InfluxDB query API.
+type influxQueryResult struct {
+	StatementID int                 `json:"statement_id"`
+	Series      []influxQuerySeries `json:"series,omitempty"`
+}
+
+type influxQuerySeries struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+// influxQuery answers every statement of a query with an empty success, so
+// that clients checking databases on startup proceed. SHOW DATABASES gets an
+// empty list of databases.
+func influxQuery(w http.ResponseWriter, r *http.Request) {
+	var results []influxQueryResult
+	for _, stmt := range strings.Split(r.FormValue("q"), ";") {
+		stmt = strings.Join(strings.Fields(stmt), " ")
+		if stmt == "" {
+			continue
+		}
+		result := influxQueryResult{StatementID: len(results)}
+		if strings.EqualFold(stmt, "SHOW DATABASES") {
+			result.Series = []influxQuerySeries{{Name: "databases", Columns: []string{"name"}}}
+		}
+		results = append(results, result)
+	}
+	if results == nil {
+		results = []influxQueryResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Version", influxDBVersion)
+	json.NewEncoder(w).Encode(struct {
+		Results []influxQueryResult `json:"results"`
+	}{results})
+}
+
+// newHandler returns the HTTP handler for the InfluxDB API and the metrics
+// endpoints. Samples are exposed from reg.
+func newHandler(c *influxDBCollector, reg prometheus.Gatherer) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/write", c.influxDBPost)
+	mux.HandleFunc("/-/dump", c.dump)
+	mux.HandleFunc("/-/series", c.series)
+
+	// Some InfluxDB clients try to create a database.
+	if *compatInfluxQuery {
+		mux.HandleFunc("/query", influxQuery)
+	} else {
+		mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"results": []}`)
+		})
+	}
+
+	// Some InfluxDB clients want to check if the http server is an influx endpoint
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", influxDBVersion)
+		// InfluxDB returns a 204 on success.
+		http.Error(w, "", http.StatusNoContent)
+	})
+
+	metrics := maxAgeHandler(c, reg, c.logger)
+	if *startupDelay > 0 {
+		metrics = warmupHandler(metrics, time.Now().Add(*startupDelay))
+	}
+	mux.Handle(*metricsPath, metrics)
+	mux.Handle(*exporterMetricsPath, promhttp.Handler())
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`<html>
+    <head><title>InfluxDB Exporter</title></head>
+    <body>
+    <h1>InfluxDB Exporter</h1>
+    <p><a href="` + *metricsPath + `">Metrics</a></p>
+    <p><a href="` + *exporterMetricsPath + `">Exporter Metrics</a></p>
+    </body>
+    </html>`))
+	})
+
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	h := countRequests(mux)
+	if *logRequests {
+		h = accessLog(h, c.logger)
+	}
+	return h
+}
+
 func init() {
+	// Accept unsigned integer fields such as 1u, as written by InfluxDB 2
+	// clients.
+	models.EnableUintSupport()
+
 	influxDbRegistry.MustRegister(version.NewCollector("influxdb_exporter"))
 	influxDbRegistry.MustRegister(udpParseErrors)
+	influxDbRegistry.MustRegister(invalidNamePoints)
+	influxDbRegistry.MustRegister(measurementSamples)
+	influxDbRegistry.MustRegister(duplicateSamples)
+	influxDbRegistry.MustRegister(graphiteDroppedSamples)
+	influxDbRegistry.MustRegister(labelLimitSamples)
+	influxDbRegistry.MustRegister(encodeErrors)
+	influxDbRegistry.MustRegister(cardinalityWarnings)
+	influxDbRegistry.MustRegister(untimestampedPoints)
+	influxDbRegistry.MustRegister(renderTimeouts)
+	influxDbRegistry.MustRegister(bytesIngested)
+	influxDbRegistry.MustRegister(vmPushFailures)
+	influxDbRegistry.MustRegister(httpRequests)
+	influxDbRegistry.MustRegister(outOfRangePoints)
+	influxDbRegistry.MustRegister(scrapeSamples)
+	influxDbRegistry.MustRegister(missingLabelSamples)
+	influxDbRegistry.MustRegister(parseRate.gauge)
+	influxDbRegistry.MustRegister(rejectedConnections)
+	influxDbRegistry.MustRegister(nameCollisionsTotal)
+	influxDbRegistry.MustRegister(measurementLastUpdate)
+	influxDbRegistry.MustRegister(parseSuccess.gauge)
+	influxDbRegistry.MustRegister(vmBreakerDropped)
 }
 
 func main() {
@@ -333,6 +1748,135 @@ func main() {
 	level.Info(logger).Log("msg", "Starting influxdb_exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
 
+	for measurement, precision := range *measurementPrecision {
+		p, err := parsePrecision(precision)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid measurement precision", "measurement", measurement, "err", err)
+			os.Exit(1)
+		}
+		(*measurementPrecision)[measurement] = p
+	}
+
+	units, err := parseUnitSuffixes(*unitSuffixFlag)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid unit suffix", "err", err)
+		os.Exit(1)
+	}
+	unitSuffixes = units
+
+	for field, typ := range *fieldTypeFlag {
+		t, err := parseValueType(typ)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid field type", "field", field, "err", err)
+			os.Exit(1)
+		}
+		fieldTypes[field] = t
+	}
+
+	if *schemaFile != "" {
+		fields, err := loadSchema(*schemaFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading schema", "file", *schemaFile, "err", err)
+			os.Exit(1)
+		}
+		schema = fields
+	}
+
+	if *outputShards < 1 {
+		level.Error(logger).Log("msg", "Invalid number of output shards", "shards", *outputShards)
+		os.Exit(1)
+	}
+
+	if !model.LabelName(*digitPrefix).IsValid() {
+		level.Error(logger).Log("msg", "Invalid digit prefix", "prefix", *digitPrefix)
+		os.Exit(1)
+	}
+
+	for _, part := range []*string{nameNamespace, nameSubsystem} {
+		if *part != "" {
+			ReplaceInvalidChars(part)
+		}
+	}
+
+	for field, expression := range *fieldExprFlag {
+		e, err := parseExpr(expression)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid field expression", "field", field, "expr", expression, "err", err)
+			os.Exit(1)
+		}
+		fieldExprs[field] = e
+	}
+
+	for field, mapping := range *fieldEnumFlag {
+		values, err := parseEnum(mapping)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid field enum", "field", field, "enum", mapping, "err", err)
+			os.Exit(1)
+		}
+		fieldEnums[field] = values
+	}
+	if *fieldEnumDefault != "" {
+		n, err := strconv.ParseFloat(*fieldEnumDefault, 64)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid field enum default", "default", *fieldEnumDefault, "err", err)
+			os.Exit(1)
+		}
+		fieldEnumUnknown = &n
+	}
+
+	for field, quantile := range *summaryQuantileFlag {
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil || q < 0 || q > 1 {
+			level.Error(logger).Log("msg", "Invalid summary quantile", "field", field, "quantile", quantile)
+			os.Exit(1)
+		}
+		summaryQuantiles[field] = q
+	}
+
+	for _, p := range append(*fieldKeep, *fieldDrop...) {
+		if _, err := path.Match(p, ""); err != nil {
+			level.Error(logger).Log("msg", "Invalid field pattern", "pattern", p, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, p := range *timestampSkip {
+		if _, err := path.Match(p, ""); err != nil {
+			level.Error(logger).Log("msg", "Invalid measurement pattern", "pattern", p, "err", err)
+			os.Exit(1)
+		}
+	}
+	for p := range *vmRoutes {
+		if _, err := path.Match(p, ""); err != nil {
+			level.Error(logger).Log("msg", "Invalid route pattern", "pattern", p, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	for from, to := range *labelRename {
+		if !model.LabelName(to).IsValid() || strings.HasPrefix(to, "__") {
+			level.Error(logger).Log("msg", "Invalid label rename", "from", from, "to", to)
+			os.Exit(1)
+		}
+	}
+
+	if *contentTypeOverride != "" {
+		if err := checkContentType(*contentTypeOverride, *formatVersion); err != nil {
+			level.Error(logger).Log("msg", "Invalid content type override", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *emitUp && !model.IsValidMetricName(model.LabelValue(*upName)) {
+		level.Error(logger).Log("msg", "Invalid up metric name", "name", *upName)
+		os.Exit(1)
+	}
+
+	if *nameAsLabels && !model.IsValidMetricName(model.LabelValue(*nameAsLabelsMetric)) {
+		level.Error(logger).Log("msg", "Invalid metric name for --name.as-labels", "name", *nameAsLabelsMetric)
+		os.Exit(1)
+	}
+
 	c := newInfluxDBCollector(logger)
 	influxDbRegistry.MustRegister(c)
 
@@ -351,34 +1895,39 @@ func main() {
 	c.conn = conn
 	go c.serveUdp()
 
-	http.HandleFunc("/write", c.influxDBPost)
-
-	// Some InfluxDB clients try to create a database.
-	http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, `{"results": []}`)
-	})
-
-	// Some InfluxDB clients want to check if the http server is an influx endpoint
-	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		// InfluxDB returns a 204 on success.
-		http.Error(w, "", http.StatusNoContent)
-	})
-
-	http.Handle(*metricsPath, promhttp.HandlerFor(influxDbRegistry, promhttp.HandlerOpts{}))
-	http.Handle(*exporterMetricsPath, promhttp.Handler())
+	if *graphiteAddress != "" {
+		c.graphite = newGraphiteForwarder(*graphiteAddress, *graphiteFlushInterval, logger)
+		go c.graphite.run()
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-    <head><title>InfluxDB Exporter</title></head>
-    <body>
-    <h1>InfluxDB Exporter</h1>
-    <p><a href="` + *metricsPath + `">Metrics</a></p>
-    <p><a href="` + *exporterMetricsPath + `">Exporter Metrics</a></p>
-    </body>
-    </html>`))
-	})
+	// Only push the stored samples, not the self-metrics.
+	pushers := newVMPushers(c, *vmImportURL, *vmRoutes, *vmPushInterval, logger)
+	for _, p := range pushers {
+		go p.run()
+	}
+	if *shutdownFlush {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			flushOnShutdown(sig, pushers, *shutdownFlushTimeout, logger)
+			os.Exit(0)
+		}()
+	}
 
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	ln, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
+		os.Exit(1)
+	}
+	if *maxConnections > 0 {
+		ln = newLimitListener(ln, *maxConnections)
+	}
+	srv := &http.Server{
+		Handler:     newHandler(c, influxDbRegistry),
+		IdleTimeout: *idleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(*keepAlive)
+	if err := srv.Serve(ln); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		os.Exit(1)
 	}
@@ -14,11 +14,30 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const (
@@ -30,6 +49,702 @@ var (
 	name   = "name"
 )
 
+func TestMain(m *testing.M) {
+	// Flag defaults are only applied on parse, which main does not get to do.
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// writeLines parses line protocol and hands the points to the collector.
+func writeLines(t *testing.T, c *influxDBCollector, lines string) {
+	t.Helper()
+	points, err := models.ParsePointsWithPrecision([]byte(lines), time.Now().UTC(), "ns")
+	if err != nil {
+		t.Fatalf("error parsing points: %s", err)
+	}
+	c.parsePointsToSample(points)
+}
+
+// waitForSamples blocks until the collector holds at least n samples.
+func waitForSamples(t *testing.T, c *influxDBCollector, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		l := len(c.storedSamples())
+		c.mu.Unlock()
+		if l >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d samples, have %d", n, l)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// sampleNames returns the sorted names of all samples held by the collector.
+func sampleNames(c *influxDBCollector) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.samples))
+	for _, s := range c.samples {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// gather collects the collector's metrics the same way the /metrics endpoint does.
+func gather(t *testing.T, c *influxDBCollector) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+	return mfs
+}
+
+// findFamily returns the family with the given name, or nil.
+func findFamily(mfs []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	return nil
+}
+
+// labelValue returns the value of the named label of m, or "".
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestStrictNames(t *testing.T) {
+	defer func(v bool) { *strictNames = v }(*strictNames)
+	*strictNames = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, invalidNamePoints)
+	writeLines(t, c, "cpu-load value=1\ncpu,host-name=a value=2\ncpu load.avg=3\ncpu_load value=4\n")
+	waitForSamples(t, c, 1)
+
+	if got, want := sampleNames(c), []string{"cpu_load"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+	if got := counterValue(t, invalidNamePoints) - before; got != 3 {
+		t.Errorf("got %v rejected points, want 3", got)
+	}
+}
+
+func TestPrecisionHeader(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+
+	req := httptest.NewRequest("POST", "/write?precision=ms", strings.NewReader("cpu value=1 1600000000\n"))
+	req.Header.Set("X-Influx-Precision", "s")
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	waitForSamples(t, c, 1)
+
+	c.mu.Lock()
+	ts := c.samples["cpu"].Timestamp
+	c.mu.Unlock()
+	if want := time.Unix(1600000000, 0); !ts.Equal(want) {
+		t.Errorf("got timestamp %s, want %s", ts, want)
+	}
+
+	req = httptest.NewRequest("POST", "/write", strings.NewReader("cpu value=1 1600000000\n"))
+	req.Header.Set("X-Influx-Precision", "fortnight")
+	rec = httptest.NewRecorder()
+	c.influxDBPost(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for invalid precision, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestNameAsLabels(t *testing.T) {
+	defer func(v bool) { *nameAsLabels = v }(*nameAsLabels)
+	*nameAsLabels = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu usage=1\nmem usage=2\n")
+	waitForSamples(t, c, 2)
+
+	mf := findFamily(gather(t, c), "influxdb")
+	if mf == nil {
+		t.Fatal("no influxdb metric family")
+	}
+	if len(mf.Metric) != 2 {
+		t.Fatalf("got %d series, want 2", len(mf.Metric))
+	}
+	var measurements []string
+	for _, m := range mf.Metric {
+		if got := labelValue(m, "field"); got != "usage" {
+			t.Errorf("got field label %q, want usage", got)
+		}
+		measurements = append(measurements, labelValue(m, "measurement"))
+	}
+	sort.Strings(measurements)
+	if got := strings.Join(measurements, ","); got != "cpu,mem" {
+		t.Errorf("got measurement labels %s, want cpu,mem", got)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	defer func(v bool) { *enablePprof = v }(*enablePprof)
+	c := newInfluxDBCollector(log.NewNopLogger())
+
+	for _, enabled := range []bool{false, true} {
+		*enablePprof = enabled
+		want := http.StatusNotFound
+		if enabled {
+			want = http.StatusOK
+		}
+		rec := httptest.NewRecorder()
+		newHandler(c, prometheus.NewRegistry()).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+		if rec.Code != want {
+			t.Errorf("pprof enabled=%v: got status %d, want %d", enabled, rec.Code, want)
+		}
+	}
+}
+
+func TestTimestampDropOlderThan(t *testing.T) {
+	defer func(v bool, d time.Duration) { *exportTimestamp, *timestampMaxAge = v, d }(*exportTimestamp, *timestampMaxAge)
+	*exportTimestamp = true
+	*timestampMaxAge = time.Minute
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	now := time.Now()
+	writeLines(t, c, fmt.Sprintf("old value=1 %d\nrecent value=2 %d\n", now.Add(-2*time.Minute).UnixNano(), now.UnixNano()))
+	waitForSamples(t, c, 2)
+
+	mfs := gather(t, c)
+	if m := findFamily(mfs, "old").Metric[0]; m.TimestampMs != nil {
+		t.Errorf("old sample exported with timestamp %d", m.GetTimestampMs())
+	}
+	if m := findFamily(mfs, "recent").Metric[0]; m.TimestampMs == nil {
+		t.Error("recent sample exported without timestamp")
+	}
+}
+
+func TestPrometheusNameTag(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, `prometheus,__name__=http_request_duration_seconds_bucket,le=0.1 value=3
+prometheus,__name__=http_request_duration_seconds_bucket,le=0.5 value=5
+`)
+	waitForSamples(t, c, 2)
+
+	mf := findFamily(gather(t, c), "http_request_duration_seconds_bucket")
+	if mf == nil {
+		t.Fatal("no http_request_duration_seconds_bucket metric family")
+	}
+	if len(mf.Metric) != 2 {
+		t.Fatalf("got %d series, want 2", len(mf.Metric))
+	}
+	for i, want := range []struct {
+		le    string
+		value float64
+	}{{"0.1", 3}, {"0.5", 5}} {
+		m := mf.Metric[i]
+		if got := labelValue(m, "le"); got != want.le {
+			t.Errorf("got le %q, want %q", got, want.le)
+		}
+		if got := labelValue(m, "__name__"); got != "" {
+			t.Errorf("got __name__ label %q, want none", got)
+		}
+		if got := m.GetUntyped().GetValue(); got != want.value {
+			t.Errorf("le=%s: got value %v, want %v", want.le, got, want.value)
+		}
+	}
+}
+
+func TestMeasurementSamples(t *testing.T) {
+	measurementSamples.Reset()
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,core=0 usage=1\ncpu,core=1 usage=2\ncpu,core=1 usage=3\nmem used=4\n")
+	waitForSamples(t, c, 3)
+
+	for measurement, want := range map[string]float64{"cpu": 2, "mem": 1} {
+		if got := gaugeValue(t, measurementSamples.WithLabelValues(measurement)); got != want {
+			t.Errorf("%s: got %v samples, want %v", measurement, got, want)
+		}
+	}
+
+	c.expireSamples(time.Now().Add(time.Hour))
+	if got := collectLen(t, measurementSamples); got != 0 {
+		t.Errorf("got %d measurements after expiry, want 0", got)
+	}
+}
+
+// collectLen returns the number of metrics collected from c.
+func collectLen(t *testing.T, c prometheus.Collector) int {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+func TestMeasurementPrecision(t *testing.T) {
+	defer func(m map[string]string) { *measurementPrecision = m }(*measurementPrecision)
+	*measurementPrecision = map[string]string{"legacy": "s"}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	req := httptest.NewRequest("POST", "/write", strings.NewReader("legacy value=1 1600000000\ncpu value=2 1600000000000000000\n"))
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	waitForSamples(t, c, 2)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range []string{"legacy", "cpu"} {
+		if got, want := c.samples[id].Timestamp, time.Unix(1600000000, 0); !got.Equal(want) {
+			t.Errorf("%s: got timestamp %s, want %s", id, got, want)
+		}
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	defer func(d time.Duration) { *dedupWindow = d }(*dedupWindow)
+	*dedupWindow = time.Minute
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, duplicateSamples)
+	batch := "cpu value=1 1600000000000000000\nmem value=2 1600000000000000000\n"
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader(batch)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+		}
+	}
+	// Samples are processed in order, so the retried batch has been handled
+	// once this one is stored.
+	writeLines(t, c, "disk value=3 1600000000000000000\n")
+	waitForSamples(t, c, 3)
+
+	if got := counterValue(t, duplicateSamples) - before; got != 2 {
+		t.Errorf("got %v duplicate samples, want 2", got)
+	}
+}
+
+func TestTimestampRoundDedup(t *testing.T) {
+	defer func(w, r time.Duration) { *dedupWindow, *timestampRound = w, r }(*dedupWindow, *timestampRound)
+	*dedupWindow = time.Minute
+	*timestampRound = time.Second
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, duplicateSamples)
+	second := time.Now().Truncate(time.Second)
+	first := second.Add(200 * time.Millisecond)
+	writeLines(t, c, fmt.Sprintf("cpu value=1 %d\ncpu value=2 %d\ndone value=1\n", first.UnixNano(), first.Add(10*time.Millisecond).UnixNano()))
+	waitForSamples(t, c, 2)
+
+	if got := counterValue(t, duplicateSamples) - before; got != 1 {
+		t.Errorf("got %v duplicate samples, want 1", got)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.samples["cpu"]
+	if !ok {
+		t.Fatal("cpu not found")
+	}
+	if s.Value != 1 || !s.Timestamp.Equal(second) {
+		t.Errorf("got value %v at %v, want 1 at %v", s.Value, s.Timestamp, second)
+	}
+}
+
+func TestSanitizeLabelValues(t *testing.T) {
+	defer func(v bool) { *sanitizeValues = v }(*sanitizeValues)
+	*sanitizeValues = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	points := []models.Point{
+		models.MustNewPoint("cpu", models.NewTags(map[string]string{"host": "a\nb", "zone": "zürich"}), models.Fields{"value": 1.0}, time.Now()),
+	}
+	c.parsePointsToSample(points)
+	waitForSamples(t, c, 1)
+
+	m := findFamily(gather(t, c), "cpu").Metric[0]
+	if got, want := labelValue(m, "host"), "a_b"; got != want {
+		t.Errorf("got host %q, want %q", got, want)
+	}
+	if got, want := labelValue(m, "zone"), "zürich"; got != want {
+		t.Errorf("got zone %q, want %q", got, want)
+	}
+}
+
+func TestUnitNormalize(t *testing.T) {
+	defer func(v bool, u []unitSuffix) { *unitNormalize, unitSuffixes = v, u }(*unitNormalize, unitSuffixes)
+	*unitNormalize = true
+	units, err := parseUnitSuffixes(map[string]string{"ms": "seconds:0.001", "kb": "bytes:1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unitSuffixes = units
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "http duration_ms=1500,size_kb=2,count=3\n")
+	waitForSamples(t, c, 3)
+
+	mfs := gather(t, c)
+	for name, want := range map[string]float64{"http_duration_seconds": 1.5, "http_size_bytes": 2048, "http_count": 3} {
+		mf := findFamily(mfs, name)
+		if mf == nil {
+			t.Errorf("no %s metric family", name)
+			continue
+		}
+		if got := mf.Metric[0].GetUntyped().GetValue(); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := parseUnitSuffixes(map[string]string{"ms": "seconds"}); err == nil {
+		t.Error("expected error for unit suffix without scale")
+	}
+}
+
+func TestLabelMaxCount(t *testing.T) {
+	defer func(n int, a string) { *maxLabels, *maxLabelsAction = n, a }(*maxLabels, *maxLabelsAction)
+	*maxLabels = 2
+
+	*maxLabelsAction = "truncate"
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, labelLimitSamples)
+	writeLines(t, c, "cpu,d=4,b=2,a=1,c=3 value=1\n")
+	waitForSamples(t, c, 1)
+	m := findFamily(gather(t, c), "cpu").Metric[0]
+	if len(m.Label) != 2 || labelValue(m, "a") != "1" || labelValue(m, "b") != "2" {
+		t.Errorf("got labels %v, want a and b", m.Label)
+	}
+
+	*maxLabelsAction = "drop"
+	c = newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,d=4,b=2,a=1,c=3 value=1\nmem,a=1 value=2\n")
+	waitForSamples(t, c, 1)
+	if got, want := sampleNames(c), []string{"mem"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+
+	if got := counterValue(t, labelLimitSamples) - before; got != 2 {
+		t.Errorf("got %v samples over the label limit, want 2", got)
+	}
+}
+
+func TestLabelMaxCountNameAsLabels(t *testing.T) {
+	defer func(n int, a string) { *maxLabels, *maxLabelsAction = n, a }(*maxLabels, *maxLabelsAction)
+	defer func(v bool) { *nameAsLabels = v }(*nameAsLabels)
+	*maxLabels, *maxLabelsAction = 2, "truncate"
+	*nameAsLabels = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=1\nmem,host=a usage=2\n")
+	waitForSamples(t, c, 2)
+
+	mf := findFamily(gather(t, c), "influxdb")
+	if mf == nil || len(mf.Metric) != 2 {
+		t.Fatalf("got family %v, want a series per measurement", mf)
+	}
+	for _, m := range mf.Metric {
+		if labelValue(m, "measurement") == "" || labelValue(m, "field") != "usage" || labelValue(m, "host") != "a" {
+			t.Errorf("got labels %v, want measurement, field and host", m.Label)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	defer func(n int64) { *maxRequestSize = n }(*maxRequestSize)
+	*maxRequestSize = 1024
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	srv := httptest.NewServer(newHandler(c, prometheus.NewRegistry()))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	post := func(body io.Reader) int {
+		req, err := http.NewRequest("POST", srv.URL+"/write", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := post(strings.NewReader("cpu value=1\n")); got != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", got, http.StatusNoContent)
+	}
+	waitForSamples(t, c, 1)
+
+	// Hide the length so the body is streamed and cut off by the limit.
+	large := strings.Repeat("cpu value=1\n", 1000)
+	if got := post(ioutil.NopCloser(strings.NewReader(large))); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for oversized body, want %d", got, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestDropInternal(t *testing.T) {
+	defer func(v bool) { *dropInternal = v }(*dropInternal)
+	*dropInternal = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	for target, body := range map[string]string{
+		"/write?db=_internal": "runtime,hostname=a HeapAlloc=1\n",
+		"/write?db=telegraf":  "app,hostname=a used=1,_gc=2\n",
+	} {
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: got status %d, want %d", target, rec.Code, http.StatusNoContent)
+		}
+	}
+	waitForSamples(t, c, 1)
+
+	if got, want := sampleNames(c), []string{"app_used"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+}
+
+func TestFieldTypes(t *testing.T) {
+	defer func(m map[string]prometheus.ValueType) { fieldTypes = m }(fieldTypes)
+	fieldTypes = map[string]prometheus.ValueType{
+		"temperature": prometheus.GaugeValue,
+		"errors":      prometheus.CounterValue,
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu temperature=50,errors=1,load=2\ndisk temperature=30,errors=3\n")
+	waitForSamples(t, c, 5)
+
+	mfs := gather(t, c)
+	for name, want := range map[string]dto.MetricType{
+		"cpu_temperature":  dto.MetricType_GAUGE,
+		"disk_temperature": dto.MetricType_GAUGE,
+		"cpu_errors":       dto.MetricType_COUNTER,
+		"disk_errors":      dto.MetricType_COUNTER,
+		"cpu_load":         dto.MetricType_UNTYPED,
+	} {
+		if got := findFamily(mfs, name).GetType(); got != want {
+			t.Errorf("%s: got type %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestTrimPrefix(t *testing.T) {
+	defer func(v string) { *trimPrefix = v }(*trimPrefix)
+	*trimPrefix = "telegraf_"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "telegraf_cpu usage=1\nmem_telegraf_ used=2\ntelegraf_ used=3\n")
+	waitForSamples(t, c, 3)
+
+	if got, want := sampleNames(c), []string{"cpu_usage", "mem_telegraf__used", "telegraf__used"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+}
+
+func TestDump(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	ts := time.Unix(1600000000, 123)
+	c.parsePointsToSample([]models.Point{
+		models.MustNewPoint("cpu", models.NewTags(map[string]string{"host": "a b,c=d", "path": `C:\dir`}), models.Fields{"usage": 1.5}, ts),
+	})
+	waitForSamples(t, c, 1)
+
+	rec := httptest.NewRecorder()
+	c.dump(rec, httptest.NewRequest("GET", "/-/dump", nil))
+	points, err := models.ParsePoints(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("error reparsing dump %q: %s", rec.Body, err)
+	}
+	if len(points) != 1 {
+		t.Fatalf("got %d points, want 1", len(points))
+	}
+	p := points[0]
+	fields, err := p.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Name()) != "cpu_usage" || !p.Time().Equal(ts) || fields["value"] != 1.5 {
+		t.Errorf("got point %s", p)
+	}
+	if got := p.Tags().Map(); len(got) != 2 || got["host"] != "a b,c=d" || got["path"] != `C:\dir` {
+		t.Errorf("got tags %v", got)
+	}
+}
+
+func TestFieldKeepDrop(t *testing.T) {
+	defer func(k, d []string) { *fieldKeep, *fieldDrop = k, d }(*fieldKeep, *fieldDrop)
+	line := "cpu usage_idle=1,usage_user=2,usage_system=3,time_guest=4\n"
+
+	for _, tc := range []struct {
+		keep, drop []string
+		want       []string
+	}{
+		{[]string{"usage_idle"}, nil, []string{"cpu_usage_idle"}},
+		{[]string{"usage_*"}, []string{"*_system"}, []string{"cpu_usage_idle", "cpu_usage_user"}},
+		{nil, []string{"usage_*"}, []string{"cpu_time_guest"}},
+	} {
+		*fieldKeep, *fieldDrop = tc.keep, tc.drop
+		c := newInfluxDBCollector(log.NewNopLogger())
+		writeLines(t, c, line)
+		waitForSamples(t, c, len(tc.want))
+		if got := sampleNames(c); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("keep %v drop %v: got samples %v, want %v", tc.keep, tc.drop, got, tc.want)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	newHandler(c, prometheus.NewRegistry()).ServeHTTP(rec, httptest.NewRequest("GET", "/ping", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if got := rec.Header().Get("X-Influxdb-Version"); got != influxDBVersion {
+		t.Errorf("got X-Influxdb-Version %q, want %q", got, influxDBVersion)
+	}
+}
+
+func TestNameDual(t *testing.T) {
+	defer func(v bool) { *nameDual = v }(*nameDual)
+	*nameDual = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=1\n")
+	waitForSamples(t, c, 1)
+
+	c.mu.Lock()
+	_, ok := c.samples["cpu_usage.host.a.measurement.cpu"]
+	c.mu.Unlock()
+	if !ok {
+		t.Error("measurement label is not part of the sample ID")
+	}
+	mf := findFamily(gather(t, c), "cpu_usage")
+	if mf == nil {
+		t.Fatal("no cpu_usage metric family")
+	}
+	if got := labelValue(mf.Metric[0], "measurement"); got != "cpu" {
+		t.Errorf("got measurement label %q, want cpu", got)
+	}
+}
+
+func TestNameDualTrimPrefix(t *testing.T) {
+	defer func(v bool, p string) { *nameDual, *trimPrefix = v, p }(*nameDual, *trimPrefix)
+	*nameDual, *trimPrefix = true, "telegraf_"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "telegraf_cpu usage=1\n")
+	waitForSamples(t, c, 1)
+
+	mf := findFamily(gather(t, c), "cpu_usage")
+	if mf == nil {
+		t.Fatal("no cpu_usage metric family")
+	}
+	if got := labelValue(mf.Metric[0], "measurement"); got != "cpu" {
+		t.Errorf("got measurement label %q, want cpu", got)
+	}
+}
+
+func TestReplaceDots(t *testing.T) {
+	defer func(v bool, with string) { *replaceDots, *replaceDotsWith = v, with }(*replaceDots, *replaceDotsWith)
+	*replaceDots = true
+
+	for with, want := range map[string]string{"_": "10_0_0_1", "-": "10-0-0-1"} {
+		*replaceDotsWith = with
+		c := newInfluxDBCollector(log.NewNopLogger())
+		writeLines(t, c, "cpu,host=10.0.0.1 usage.idle=1\n")
+		waitForSamples(t, c, 1)
+
+		mf := findFamily(gather(t, c), "cpu_usage_idle")
+		if mf == nil {
+			t.Fatal("no cpu_usage_idle metric family")
+		}
+		if got := labelValue(mf.Metric[0], "host"); got != want {
+			t.Errorf("replacing with %q: got host %q, want %q", with, got, want)
+		}
+	}
+}
+
+func TestStaleMarkers(t *testing.T) {
+	defer func(v bool) { *staleMarkers = v }(*staleMarkers)
+	*staleMarkers = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu value=1\n")
+	waitForSamples(t, c, 1)
+	c.expireSamples(time.Now().Add(time.Hour))
+
+	mf := findFamily(gather(t, c), "cpu")
+	if mf == nil || len(mf.Metric) != 1 {
+		t.Fatalf("got family %v, want a single stale marker", mf)
+	}
+	if got := math.Float64bits(mf.Metric[0].GetUntyped().GetValue()); got != staleNaNBits {
+		t.Errorf("got value bits %x, want stale marker %x", got, staleNaNBits)
+	}
+	if mf := findFamily(gather(t, c), "cpu"); mf != nil {
+		t.Errorf("stale marker exposed again: %v", mf)
+	}
+}
+
+func TestTrimFieldSuffix(t *testing.T) {
+	defer func(v string) { *trimFieldSuffix = v }(*trimFieldSuffix)
+	*trimFieldSuffix = "_value"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "sensor temperature_value=1,humidity=2,value_max=3\n")
+	waitForSamples(t, c, 3)
+
+	if got, want := sampleNames(c), []string{"sensor_humidity", "sensor_temperature", "sensor_value_max"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+}
+
 func BenchmarkRegexpReplaceInvalid(b *testing.B) {
 	b.ReportAllocs()
 	invalidChars := regexp.MustCompile("[^a-zA-Z0-9_]")
@@ -61,7 +776,7 @@ func BenchmarkSprintfArray(b *testing.B) {
 		for _, l := range labelnames {
 			parts = append(parts, l, labels[l])
 		}
-		fmt.Sprintf("%q", parts)
+		_ = fmt.Sprintf("%q", parts)
 	}
 }
 
@@ -83,3 +798,1036 @@ func BenchmarkStringJoin(b *testing.B) {
 		strings.Join(parts, ".")
 	}
 }
+
+// telegrafFixture returns n lines resembling Telegraf's cpu, mem and disk
+// input plugins.
+func telegrafFixture(n int) []byte {
+	var b strings.Builder
+	ts := time.Unix(1600000000, 0)
+	for i := 0; i < n; i++ {
+		ts = ts.Add(10 * time.Second)
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(&b, "cpu,cpu=cpu%d,host=server%02d usage_idle=%d.5,usage_system=1.25,usage_user=3.75,usage_iowait=0i %d\n", i%8, i%20, i%100, ts.UnixNano())
+		case 1:
+			fmt.Fprintf(&b, "mem,host=server%02d active=%di,available=8123456i,available_percent=61.2,buffered=123456i,used_percent=38.8 %d\n", i%20, i, ts.UnixNano())
+		case 2:
+			fmt.Fprintf(&b, "disk,device=sda%d,fstype=ext4,host=server%02d,mode=rw,path=/data%d free=%di,inodes_used=1234i,used_percent=42.1 %d\n", i%4, i%20, i%4, i, ts.UnixNano())
+		}
+	}
+	return []byte(b.String())
+}
+
+func BenchmarkParsePointsWithPrecision(b *testing.B) {
+	buf := telegrafFixture(10000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), "ns"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// repetitiveNames returns n names cycling through a small set of Telegraf
+// style measurement and field names that need sanitizing.
+func repetitiveNames(n int) []string {
+	base := []string{
+		"net_response.response-time", "http.response.status-code", "disk.io-time",
+		"win_cpu.Percent_Processor_Time", "sql.server.wait-stats", "nginx.active-connections",
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = base[i%len(base)]
+	}
+	return names
+}
+
+func BenchmarkSanitizeName(b *testing.B) {
+	names := repetitiveNames(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			ReplaceInvalidChars(&name)
+		}
+	}
+}
+
+func BenchmarkSanitizeNameCached(b *testing.B) {
+	names := repetitiveNames(1000)
+	cache := newNameCache(100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			cache.sanitize(name)
+		}
+	}
+}
+
+func TestParseWorkers(t *testing.T) {
+	defer func(v int) { *parseWorkers = v }(*parseWorkers)
+	*parseWorkers = 4
+
+	const (
+		writers = 8
+		series  = 50
+		lines   = 1000
+	)
+	batch := func(writer int) string {
+		var b strings.Builder
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(&b, "cpu,writer=%d,n=%d value=%d\n", writer, i%series, i)
+		}
+		return b.String()
+	}
+
+	want, err := parsePoints([]byte(batch(0)), time.Unix(0, 0), "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parsePointsParallel([]byte(batch(0)), time.Unix(0, 0), "ns", *parseWorkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d points, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i].String() {
+			t.Fatalf("point %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader(batch(w))))
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+			}
+		}(w)
+	}
+	wg.Wait()
+	// Samples are processed in order, so all writes have been handled once
+	// this one is stored.
+	writeLines(t, c, "done value=1\n")
+	waitForSamples(t, c, writers*series+1)
+
+	for _, m := range findFamily(gather(t, c), "cpu").Metric {
+		n, err := strconv.Atoi(labelValue(m, "n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last line for each series wins.
+		if got, want := m.GetUntyped().GetValue(), float64(lines-series+n); got != want {
+			t.Errorf("writer %s n %d: got %v, want %v", labelValue(m, "writer"), n, got, want)
+		}
+	}
+}
+
+func TestNameCache(t *testing.T) {
+	buf := append(telegrafFixture(300), "net.response,server-name=a response-time=1\n1cpu,9zone=b value=2\n"...)
+	output := func() []*dto.MetricFamily {
+		c := newInfluxDBCollector(log.NewNopLogger())
+		points, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.parsePointsToSample(points)
+		// Samples are processed in order, so all points have been handled
+		// once this one is stored.
+		writeLines(t, c, "done value=1\n")
+		for {
+			c.mu.Lock()
+			_, done := c.samples["done"]
+			delete(c.samples, "done")
+			c.mu.Unlock()
+			if done {
+				return gather(t, c)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	want := output()
+
+	// A cache smaller than the number of names also exercises eviction.
+	for _, size := range []int{1000, 3} {
+		func() {
+			defer func(v int) { *nameCacheSize = v }(*nameCacheSize)
+			*nameCacheSize = size
+			if got := output(); !reflect.DeepEqual(got, want) {
+				t.Errorf("cache size %d: got %v, want %v", size, got, want)
+			}
+		}()
+	}
+}
+
+func TestSummaryQuantiles(t *testing.T) {
+	defer func(v map[string]float64) { summaryQuantiles = v }(summaryQuantiles)
+	summaryQuantiles = map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "response_time,host=a p50=12,p90=40,p99=95.5,count=200i,sum=3100,max=120\n")
+	waitForSamples(t, c, 2)
+
+	mf := findFamily(gather(t, c), "response_time")
+	if mf == nil {
+		t.Fatal("response_time not found")
+	}
+	if got, want := mf.GetType(), dto.MetricType_SUMMARY; got != want {
+		t.Fatalf("got type %v, want %v", got, want)
+	}
+	m := mf.Metric[0]
+	if got, want := labelValue(m, "host"), "a"; got != want {
+		t.Errorf("got host %q, want %q", got, want)
+	}
+	s := m.GetSummary()
+	if s.GetSampleCount() != 200 || s.GetSampleSum() != 3100 {
+		t.Errorf("got count %d and sum %v, want 200 and 3100", s.GetSampleCount(), s.GetSampleSum())
+	}
+	want := map[float64]float64{0.5: 12, 0.9: 40, 0.99: 95.5}
+	if len(s.Quantile) != len(want) {
+		t.Fatalf("got %d quantiles, want %d", len(s.Quantile), len(want))
+	}
+	for _, q := range s.Quantile {
+		if want[q.GetQuantile()] != q.GetValue() {
+			t.Errorf("quantile %v: got %v, want %v", q.GetQuantile(), q.GetValue(), want[q.GetQuantile()])
+		}
+	}
+
+	// Other fields are exported as usual.
+	if findFamily(gather(t, c), "response_time_max") == nil {
+		t.Error("response_time_max not found")
+	}
+}
+
+func TestSummaryQuantilesValueField(t *testing.T) {
+	defer func(v map[string]float64) { summaryQuantiles = v }(summaryQuantiles)
+	summaryQuantiles = map[string]float64{"p50": 0.5}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "rt p50=1,value=42\n")
+	waitForSamples(t, c, 2)
+
+	mfs := gather(t, c)
+	if mf := findFamily(mfs, "rt"); mf == nil || mf.GetType() != dto.MetricType_UNTYPED || mf.Metric[0].GetUntyped().GetValue() != 42 {
+		t.Errorf("got family %v, want the value field as is", mf)
+	}
+	if findFamily(mfs, "rt_p50") == nil {
+		t.Error("rt_p50 not found")
+	}
+}
+
+func TestSummaryTypeGauge(t *testing.T) {
+	defer func(v map[string]float64, typ string) { summaryQuantiles, *summaryType = v, typ }(summaryQuantiles, *summaryType)
+	summaryQuantiles = map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99}
+	*summaryType = "gauge"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "response_time,host=a p50=12,p90=40,p99=95.5,count=200i\n")
+	waitForSamples(t, c, 4)
+
+	mfs := gather(t, c)
+	mf := findFamily(mfs, "response_time")
+	if mf == nil {
+		t.Fatal("response_time not found")
+	}
+	if got, want := mf.GetType(), dto.MetricType_GAUGE; got != want {
+		t.Fatalf("got type %v, want %v", got, want)
+	}
+	want := map[string]float64{"0.5": 12, "0.9": 40, "0.99": 95.5}
+	if len(mf.Metric) != len(want) {
+		t.Fatalf("got %d series, want %d", len(mf.Metric), len(want))
+	}
+	for _, m := range mf.Metric {
+		q := labelValue(m, "quantile")
+		if got := m.GetGauge().GetValue(); got != want[q] || labelValue(m, "host") != "a" {
+			t.Errorf("quantile %q: got %v, want %v", q, got, want[q])
+		}
+	}
+
+	// The count field is not part of the quantile gauges.
+	if findFamily(mfs, "response_time_count") == nil {
+		t.Error("response_time_count not found")
+	}
+}
+
+func TestNamespaceSubsystem(t *testing.T) {
+	defer func(ns, sub string) { *nameNamespace, *nameSubsystem = ns, sub }(*nameNamespace, *nameSubsystem)
+
+	for _, tc := range []struct {
+		namespace, subsystem string
+		want                 []string
+	}{
+		{"infra", "host", []string{"infra_host_cpu", "infra_host_cpu_usage_idle"}},
+		{"infra", "", []string{"infra_cpu", "infra_cpu_usage_idle"}},
+		{"", "host", []string{"host_cpu", "host_cpu_usage_idle"}},
+	} {
+		*nameNamespace, *nameSubsystem = tc.namespace, tc.subsystem
+		c := newInfluxDBCollector(log.NewNopLogger())
+		writeLines(t, c, "cpu value=1,usage_idle=2\n")
+		waitForSamples(t, c, 2)
+		if got := sampleNames(c); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("namespace %q subsystem %q: got %v, want %v", tc.namespace, tc.subsystem, got, tc.want)
+		}
+	}
+}
+
+func TestReservedLabelPolicy(t *testing.T) {
+	defer func(v string) { *reservedLabelPolicy = v }(*reservedLabelPolicy)
+
+	for policy, want := range map[string]map[string]string{
+		"prefix": {"key___foo": "a", "host": "b"},
+		"drop":   {"host": "b"},
+	} {
+		*reservedLabelPolicy = policy
+		c := newInfluxDBCollector(log.NewNopLogger())
+		writeLines(t, c, "cpu,--foo=a,host=b value=1\n")
+		waitForSamples(t, c, 1)
+
+		m := findFamily(gather(t, c), "cpu").Metric[0]
+		got := map[string]string{}
+		for _, l := range m.Label {
+			got[l.GetName()] = l.GetValue()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("policy %s: got labels %v, want %v", policy, got, want)
+		}
+	}
+}
+
+func TestUpMetric(t *testing.T) {
+	defer func(v bool) { *emitUp = v }(*emitUp)
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	if findFamily(gather(t, c), *upName) != nil {
+		t.Errorf("%s exported without --metrics.up", *upName)
+	}
+
+	*emitUp = true
+	mf := findFamily(gather(t, c), "influxdb_exporter_up")
+	if mf == nil {
+		t.Fatal("influxdb_exporter_up not found")
+	}
+	if got := mf.Metric[0].GetGauge().GetValue(); got != 1 {
+		t.Errorf("got up %v, want 1", got)
+	}
+}
+
+func TestCardinalityWarning(t *testing.T) {
+	defer func(v int) { *cardinalityThreshold = v }(*cardinalityThreshold)
+	*cardinalityThreshold = 3
+
+	var logs syncBuffer
+	c := newInfluxDBCollector(log.NewLogfmtLogger(&logs))
+	before := counterValue(t, cardinalityWarnings)
+	var lines strings.Builder
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&lines, "cpu,region=eu,host=h%d value=1\n", i)
+	}
+	lines.WriteString("mem,host=h0 value=1\n")
+	writeLines(t, c, lines.String())
+	waitForSamples(t, c, 7)
+
+	// The measurement only warns once per window.
+	if got := counterValue(t, cardinalityWarnings) - before; got != 1 {
+		t.Errorf("got %v cardinality warnings, want 1", got)
+	}
+	for _, want := range []string{"measurement=cpu", "series=4", "suspect_tag=host"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log %q does not contain %q", logs.String(), want)
+		}
+	}
+}
+
+func TestRoundDigits(t *testing.T) {
+	for _, tc := range []struct {
+		v      float64
+		digits int
+		want   float64
+	}{
+		{3.14159, 2, 3.14},
+		{3.14159, 0, 3},
+		{-2.675, 1, -2.7},
+		{1e300, 10, 1e300},
+		{math.Inf(1), 2, math.Inf(1)},
+	} {
+		if got := roundValue(tc.v, tc.digits); got != tc.want {
+			t.Errorf("roundValue(%v, %d) = %v, want %v", tc.v, tc.digits, got, tc.want)
+		}
+	}
+	if got := roundValue(math.NaN(), 2); !math.IsNaN(got) {
+		t.Errorf("roundValue(NaN, 2) = %v, want NaN", got)
+	}
+
+	defer func(v int) { *roundDigits = v }(*roundDigits)
+	*roundDigits = 2
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "pi value=3.14159\n")
+	waitForSamples(t, c, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.samples["pi"]; !ok || s.Value != 3.14 {
+		t.Errorf("got %v, want 3.14", s)
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	defer func(v bool) { *strictParams = v }(*strictParams)
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	post := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, httptest.NewRequest("POST", target, strings.NewReader("cpu value=1\n")))
+		return rec
+	}
+
+	*strictParams = false
+	if rec := post("/write?db=telegraf&bogus=1"); rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d for an unknown parameter by default, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	*strictParams = true
+	if rec := post("/write?db=telegraf&bogus=1"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "bogus") {
+		t.Errorf("got status %d (%q) for an unknown parameter in strict mode, want %d", rec.Code, rec.Body, http.StatusBadRequest)
+	}
+	if rec := post("/write?db=telegraf&rp=autogen&precision=s&org=o&bucket=b"); rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d for known parameters in strict mode, want %d", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestMeasurementLastUpdate(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	start := float64(time.Now().UnixNano()) / 1e9
+	writeLines(t, c, "lastupdate_a value=1\n")
+	waitForSamples(t, c, 1)
+	first := gaugeValue(t, measurementLastUpdate.WithLabelValues("lastupdate_a"))
+
+	time.Sleep(10 * time.Millisecond)
+	writeLines(t, c, "lastupdate_b value=1\n")
+	waitForSamples(t, c, 2)
+	second := gaugeValue(t, measurementLastUpdate.WithLabelValues("lastupdate_b"))
+
+	if first < start || second <= first {
+		t.Errorf("got last updates %v and %v, want increasing values after %v", first, second, start)
+	}
+	if got := gaugeValue(t, measurementLastUpdate.WithLabelValues("lastupdate_a")); got != first {
+		t.Errorf("writing lastupdate_b changed lastupdate_a from %v to %v", first, got)
+	}
+}
+
+func TestMeasurementLastUpdateRewrite(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "lastupdate_rewrite value=1\n")
+	waitForSamples(t, c, 1)
+	writeLines(t, c, "lastupdate_rewrite value=2\n")
+	writeLines(t, c, "lastupdate_rewrite_done value=1\n")
+	waitForSamples(t, c, 2)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(measurementLastUpdate)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+	mf := findFamily(mfs, "influxdb_exporter_measurement_last_update_seconds")
+	for _, m := range mf.GetMetric() {
+		if labelValue(m, "measurement") == "lastupdate_rewrite" {
+			return
+		}
+	}
+	t.Error("rewriting the only series of a measurement dropped its last update time")
+}
+
+func TestBareFields(t *testing.T) {
+	defer func(v []string) { *bareFields = v }(*bareFields)
+
+	for _, tc := range []struct {
+		bare []string
+		want []string
+	}{
+		{[]string{"value"}, []string{"sensor", "sensor_reading", "sensor_temp"}},
+		{[]string{"value", "reading"}, []string{"sensor", "sensor_temp"}},
+		{[]string{"reading"}, []string{"sensor", "sensor_temp", "sensor_value"}},
+	} {
+		*bareFields = tc.bare
+		c := newInfluxDBCollector(log.NewNopLogger())
+		// Separate points, as value and reading both map to sensor with
+		// --name.bare-fields=value --name.bare-fields=reading.
+		writeLines(t, c, "sensor,id=1 value=1,temp=20\nsensor,id=2 reading=2\n")
+		waitForSamples(t, c, 3)
+
+		var names []string
+		for _, mf := range gather(t, c) {
+			if strings.HasPrefix(mf.GetName(), "sensor") {
+				names = append(names, mf.GetName())
+			}
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("bare fields %v: got metrics %v, want %v", tc.bare, names, tc.want)
+		}
+	}
+}
+
+func TestDigitPrefix(t *testing.T) {
+	defer func(v string) { *digitPrefix = v }(*digitPrefix)
+
+	for prefix, want := range map[string]string{"_": "_1minuteload", "m": "m1minuteload", "load_": "load_1minuteload"} {
+		*digitPrefix = prefix
+		c := newInfluxDBCollector(log.NewNopLogger())
+		writeLines(t, c, "1minuteload value=0.5\n")
+		waitForSamples(t, c, 1)
+		if findFamily(gather(t, c), want) == nil {
+			t.Errorf("prefix %q: %s not found", prefix, want)
+		}
+	}
+}
+
+func TestRequestTime(t *testing.T) {
+	backfill := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	for target, timestamp := range map[string]string{
+		"/write?time=2020-09-13T12:26:40Z":        "1600000001000000000",
+		"/write?time=2020-09-13T14:26:40%2B02:00": "1600000001000000000",
+		"/write?precision=s&time=1600000000":      "1600000001",
+		"/write?time=1600000000000000000":         "1600000001000000000",
+	} {
+		c := newInfluxDBCollector(log.NewNopLogger())
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, httptest.NewRequest("POST", target, strings.NewReader("cpu value=1\nmem value=2 "+timestamp+"\n")))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: got status %d, want %d: %s", target, rec.Code, http.StatusNoContent, rec.Body)
+		}
+		waitForSamples(t, c, 2)
+
+		c.mu.Lock()
+		if got := c.samples["cpu"].Timestamp; !got.Equal(backfill) {
+			t.Errorf("%s: got timestamp %v for a point without one, want %v", target, got, backfill)
+		}
+		// Explicit timestamps are kept.
+		if got, want := c.samples["mem"].Timestamp, time.Unix(1600000001, 0); !got.Equal(want) {
+			t.Errorf("%s: got timestamp %v for a timestamped point, want %v", target, got, want)
+		}
+		c.mu.Unlock()
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write?time=yesterday", strings.NewReader("cpu value=1\n")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid time, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTagsetInfo(t *testing.T) {
+	defer func(v bool) { *tagsetInfo = v }(*tagsetInfo)
+	*tagsetInfo = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a,region=eu usage=1\nmem,host=a,region=eu used=2\ncpu,host=b,region=eu usage=3\n")
+	waitForSamples(t, c, 3)
+
+	mfs := gather(t, c)
+	infos := map[string]string{}
+	for _, m := range findFamily(mfs, tagsetInfoName).GetMetric() {
+		infos[labelValue(m, tagsetIDLabel)] = labelValue(m, "host")
+		if got := labelValue(m, "region"); got != "eu" {
+			t.Errorf("got region %q on the info metric, want eu", got)
+		}
+	}
+	if len(infos) != 2 {
+		t.Fatalf("got %d info metrics, want 2: %v", len(infos), infos)
+	}
+
+	hosts := map[string]string{}
+	for _, name := range []string{"cpu_usage", "mem_used"} {
+		for _, m := range findFamily(mfs, name).GetMetric() {
+			if len(m.Label) != 1 {
+				t.Errorf("%s: got labels %v, want only %s", name, m.Label, tagsetIDLabel)
+			}
+			host, ok := infos[labelValue(m, tagsetIDLabel)]
+			if !ok {
+				t.Errorf("%s: tagset_id %q has no info metric", name, labelValue(m, tagsetIDLabel))
+			}
+			hosts[fmt.Sprintf("%s %v", name, m.GetUntyped().GetValue())] = host
+		}
+	}
+	want := map[string]string{"cpu_usage 1": "a", "mem_used 2": "a", "cpu_usage 3": "b"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got references %v, want %v", hosts, want)
+	}
+}
+
+func TestNameCollisions(t *testing.T) {
+	var logs syncBuffer
+	c := newInfluxDBCollector(log.NewLogfmtLogger(&logs))
+	before := counterValue(t, nameCollisionsTotal)
+	writeLines(t, c, "a-b value=1\na.b value=2\na-b value=3\na.b value=4\nc_d value=5\ndone value=1\n")
+	waitForSamples(t, c, 3)
+
+	// Each colliding raw name is only reported once.
+	if got := counterValue(t, nameCollisionsTotal) - before; got != 1 {
+		t.Errorf("got %v name collisions, want 1", got)
+	}
+	for _, want := range []string{"name=a_b", "raw=a-b", "colliding_raw=a.b"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log %q does not contain %q", logs.String(), want)
+		}
+	}
+}
+
+func TestNameCollisionsBounded(t *testing.T) {
+	n := newNameCollisions(2, log.NewNopLogger())
+	before := counterValue(t, nameCollisionsTotal)
+	n.check("a-b", "a_b")
+	n.check("c", "c")
+	n.check("d", "d")
+	if got := n.lru.Len(); got != 2 {
+		t.Errorf("got %d remembered names, want 2", got)
+	}
+
+	// a_b was evicted, so a.b is its first raw name now.
+	n.check("a.b", "a_b")
+	n.check("d", "d")
+	if got := counterValue(t, nameCollisionsTotal) - before; got != 0 {
+		t.Errorf("got %v name collisions, want 0", got)
+	}
+	n.check("a-b", "a_b")
+	if got := counterValue(t, nameCollisionsTotal) - before; got != 1 {
+		t.Errorf("got %v name collisions, want 1", got)
+	}
+}
+
+func TestTimestampUTC(t *testing.T) {
+	defer func(v bool) { *exportTimestamp = v }(*exportTimestamp)
+	*exportTimestamp = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	ts := time.Now().Truncate(time.Millisecond)
+	writeLines(t, c, fmt.Sprintf("parsed value=1 %d\n", ts.UnixNano()))
+	local := &influxDBSample{
+		ID:        "local",
+		Name:      "local",
+		Labels:    map[string]string{},
+		Value:     2,
+		ValueType: prometheus.UntypedValue,
+		Timestamp: ts.In(time.FixedZone("UTC+5", 5*60*60)),
+	}
+	c.ch <- local
+	waitForSamples(t, c, 2)
+
+	c.mu.Lock()
+	loc := c.samples["parsed"].Timestamp.Location()
+	c.mu.Unlock()
+	if loc != time.UTC {
+		t.Errorf("got stored timestamp in %v, want UTC", loc)
+	}
+	mfs := gather(t, c)
+	for _, name := range []string{"parsed", "local"} {
+		if got, want := findFamily(mfs, name).Metric[0].GetTimestampMs(), ts.UTC().UnixNano()/int64(time.Millisecond); got != want {
+			t.Errorf("%s: got timestamp %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestTimestampRequire(t *testing.T) {
+	defer func(v bool) { *requireTimestamp = v }(*requireTimestamp)
+	*requireTimestamp = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, untimestampedPoints)
+	rec := httptest.NewRecorder()
+	// The out of range line makes the body be parsed twice.
+	body := fmt.Sprintf("with value=1 %d\nwithout,host=a\\ b value=2\nrange value=3 99999999999999999999\n", time.Now().UnixNano())
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	// Samples are processed in order, so the request has been handled once
+	// this one is stored.
+	writeLines(t, c, fmt.Sprintf("done value=1 %d\n", time.Now().UnixNano()))
+	waitForSamples(t, c, 2)
+
+	if got, want := sampleNames(c), []string{"done", "with"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+	if got := counterValue(t, untimestampedPoints) - before; got != 1 {
+		t.Errorf("got %v untimestamped points, want 1", got)
+	}
+}
+
+func TestLabelRename(t *testing.T) {
+	defer func(v map[string]string) { *labelRename = v }(*labelRename)
+	*labelRename = map[string]string{"host": "instance", "dc": "zone"}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a value=1\nmem,dc=x,zone=y,host=b value=2\n")
+	waitForSamples(t, c, 2)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, want := range map[string]map[string]string{
+		"cpu.instance.a":        {"instance": "a"},
+		"mem.instance.b.zone.y": {"instance": "b", "zone": "y"},
+	} {
+		s, ok := c.samples[id]
+		if !ok {
+			t.Errorf("sample %s not found", id)
+			continue
+		}
+		if !reflect.DeepEqual(s.Labels, want) {
+			t.Errorf("%s: got labels %v, want %v", id, s.Labels, want)
+		}
+	}
+}
+
+func TestLabelRenameChained(t *testing.T) {
+	defer func(v map[string]string) { *labelRename = v }(*labelRename)
+	*labelRename = map[string]string{"a": "b", "b": "c"}
+
+	// Map order varies between runs, so try a few times.
+	for i := 0; i < 10; i++ {
+		c := newInfluxDBCollector(log.NewNopLogger())
+		writeLines(t, c, "cpu,a=1,b=2 value=1\nmem,a=1 value=2\ndisk,b=2,c=3 value=3\n")
+		waitForSamples(t, c, 3)
+
+		c.mu.Lock()
+		for id, want := range map[string]map[string]string{
+			"cpu.b.1.c.2": {"b": "1", "c": "2"},
+			"mem.b.1":     {"b": "1"},
+			"disk.c.3":    {"c": "3"},
+		} {
+			s, ok := c.samples[id]
+			if !ok {
+				t.Errorf("sample %s not found", id)
+				continue
+			}
+			if !reflect.DeepEqual(s.Labels, want) {
+				t.Errorf("%s: got labels %v, want %v", id, s.Labels, want)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestFlattenJSONFields(t *testing.T) {
+	defer func(v []string) { *flattenJSONFields = v }(*flattenJSONFields)
+	*flattenJSONFields = []string{"stats"}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, `app stats="{\"a\":1,\"b\":{\"c\":2,\"d\":\"x\"},\"e\":[3]}",up=1i`+"\n")
+	waitForSamples(t, c, 3)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	want := map[string]float64{"app_stats_a": 1, "app_stats_b_c": 2, "app_up": 1}
+	if len(c.samples) != len(want) {
+		t.Errorf("got samples %v, want %v", c.samples, want)
+	}
+	for id, value := range want {
+		if s, ok := c.samples[id]; !ok || s.Value != value {
+			t.Errorf("%s: got %v, want %v", id, s, value)
+		}
+	}
+}
+
+func TestBytesIngested(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	body := "cpu,host=a value=1\nmem,host=a value=2\n"
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(body))
+	w.Close()
+	compressed := httptest.NewRequest("POST", "/write", &gz)
+	compressed.Header.Set("Content-Encoding", "gzip")
+
+	before := counterValue(t, bytesIngested)
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/write", strings.NewReader(body)),
+		compressed,
+	} {
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+		}
+	}
+	// Compressed bodies count with their decompressed size.
+	if got, want := counterValue(t, bytesIngested)-before, float64(2*len(body)); got != want {
+		t.Errorf("got %v bytes ingested, want %v", got, want)
+	}
+}
+
+func TestPrecisionAuto(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	want := time.Unix(1600000000, 0)
+	for i, ts := range []string{"1600000000", "1600000000000", "1600000000000000", "1600000000000000000"} {
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, httptest.NewRequest("POST", "/write?precision=auto", strings.NewReader(fmt.Sprintf("m%d value=1 %s\n", i, ts))))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+		}
+	}
+	waitForSamples(t, c, 4)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.samples {
+		if !s.Timestamp.Equal(want) {
+			t.Errorf("%s: got timestamp %s, want %s", s.Name, s.Timestamp, want)
+		}
+	}
+}
+
+func TestSampleIDDots(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "x,a=b.c.d value=1\nx,a=b,c=d value=2\nx,a=b\\.c value=3\n")
+	waitForSamples(t, c, 3)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, want := range map[string]float64{`x.a.b\.c\.d`: 1, "x.a.b.c.d": 2, `x.a.b\\\.c`: 3} {
+		if s, ok := c.samples[id]; !ok || s.Value != want {
+			t.Errorf("got sample %v for %s, want value %v", s, id, want)
+		}
+	}
+}
+
+func TestLabelValueType(t *testing.T) {
+	defer func(v bool) { *labelValueType = v }(*labelValueType)
+	*labelValueType = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "m f=1.5,i=2i,u=3u,b=true\n")
+	waitForSamples(t, c, 4)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, want := range map[string]float64{
+		"m_f.value_type.float": 1.5,
+		"m_i.value_type.int":   2,
+		"m_u.value_type.uint":  3,
+		"m_b.value_type.bool":  1,
+	} {
+		if s, ok := c.samples[id]; !ok || s.Value != want {
+			t.Errorf("%s: got %v, want %v", id, s, want)
+		}
+	}
+}
+
+func TestTimestampSkipMeasurement(t *testing.T) {
+	defer func(v bool, m []string) { *exportTimestamp, *timestampSkip = v, m }(*exportTimestamp, *timestampSkip)
+	*exportTimestamp = true
+	*timestampSkip = []string{"inventory"}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	now := time.Now().UnixNano()
+	writeLines(t, c, fmt.Sprintf("inventory,host=a disks=4i %d\ncpu,host=a usage=1 %d\n", now, now))
+	waitForSamples(t, c, 2)
+
+	mfs := gather(t, c)
+	if m := findFamily(mfs, "inventory_disks").Metric[0]; m.TimestampMs != nil {
+		t.Errorf("inventory exported with timestamp %d", m.GetTimestampMs())
+	}
+	if m := findFamily(mfs, "cpu_usage").Metric[0]; m.TimestampMs == nil {
+		t.Error("cpu exported without timestamp")
+	}
+}
+
+func TestOutOfRangeTimestamp(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, outOfRangePoints)
+	for _, tc := range []struct {
+		precision, ts string
+		now           int64
+	}{
+		{"ns", "123456789012345678901234", time.Now().UnixNano()},
+		// Fits into an int64 but not once converted to nanoseconds.
+		{"s", "1600000000000", time.Now().Unix()},
+	} {
+		body := fmt.Sprintf("overflow value=1 %s\nok_%s value=2 %d\n", tc.ts, tc.precision, tc.now)
+		rec := httptest.NewRecorder()
+		c.influxDBPost(rec, httptest.NewRequest("POST", "/write?precision="+tc.precision, strings.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: got status %d, want %d: %s", tc.ts, rec.Code, http.StatusNoContent, rec.Body)
+		}
+	}
+	waitForSamples(t, c, 2)
+
+	if got, want := sampleNames(c), []string{"ok_ns", "ok_s"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+	if got := counterValue(t, outOfRangePoints) - before; got != 2 {
+		t.Errorf("got %v out of range points, want 2", got)
+	}
+}
+
+func TestDropEmptyLabelsLineProtocol(t *testing.T) {
+	defer func(v bool) { *dropEmptyLabels = v }(*dropEmptyLabels)
+	*dropEmptyLabels = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a,zone=NaN value=1\n")
+	waitForSamples(t, c, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.samples["cpu.host.a"] == nil {
+		t.Errorf("got samples %v, want cpu.host.a", c.samples)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	r := &pointsRate{gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_rate"})}
+	r.observe(100, time.Second)
+	if got := gaugeValue(t, r.gauge); got != 100 {
+		t.Errorf("got rate %v after the first write, want 100", got)
+	}
+	r.observe(200, time.Second)
+	if got, want := gaugeValue(t, r.gauge), 0.2*200+0.8*100; got != want {
+		t.Errorf("got rate %v, want %v", got, want)
+	}
+	r.observe(0, 0)
+	if got, want := gaugeValue(t, r.gauge), 0.2*200+0.8*100; got != want {
+		t.Errorf("got rate %v after an empty write, want %v", got, want)
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write", bytes.NewReader(telegrafFixture(100))))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got := gaugeValue(t, parseRate.gauge); got <= 0 {
+		t.Errorf("got parse rate %v after a write, want > 0", got)
+	}
+}
+
+func TestParseSuccessRatio(t *testing.T) {
+	defer func(r *parseRatio) { parseSuccess = r }(parseSuccess)
+	parseSuccess = &parseRatio{gauge: parseSuccess.gauge}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader("cpu value=1\ncpu value=\nmem value=2\n# comment\ndisk value=3\n")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a batch with a bad line, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if got := gaugeValue(t, parseSuccess.gauge); got != 0.75 {
+		t.Errorf("got ratio %v, want 0.75", got)
+	}
+
+	// A window later the earlier writes still count, two windows later not.
+	r := &parseRatio{gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_ratio"})}
+	now := time.Now()
+	r.observe(4, 2, now)
+	r.observe(4, 4, now.Add(*parseRatioWindow))
+	if got := gaugeValue(t, r.gauge); got != 0.75 {
+		t.Errorf("got ratio %v after one window, want 0.75", got)
+	}
+	r.observe(2, 2, now.Add(3**parseRatioWindow))
+	if got := gaugeValue(t, r.gauge); got != 1 {
+		t.Errorf("got ratio %v after three windows, want 1", got)
+	}
+}
+
+func BenchmarkParsePointsToSample(b *testing.B) {
+	points, err := models.ParsePointsWithPrecision(telegrafFixture(1000), time.Now().UTC(), "ns")
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := newInfluxDBCollector(log.NewNopLogger())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.parsePointsToSample(points)
+	}
+}
+
+func TestFieldEnum(t *testing.T) {
+	defer func(e map[string]map[string]float64, d *float64) { fieldEnums, fieldEnumUnknown = e, d }(fieldEnums, fieldEnumUnknown)
+	values, err := parseEnum("running=1,stopped=0,error=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldEnums = map[string]map[string]float64{"state": values}
+	fieldEnumUnknown = nil
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "svc,host=a state=\"running\"\nsvc,host=b state=\"stopped\"\nsvc,host=c state=\"paused\"\nsvc,host=d other=\"x\"\nsvc,host=e done=1\n")
+	waitForSamples(t, c, 3)
+
+	c.mu.Lock()
+	for id, want := range map[string]float64{
+		"svc_state.host.a": 1,
+		"svc_state.host.b": 0,
+	} {
+		if s, ok := c.samples[id]; !ok || s.Value != want {
+			t.Errorf("%s: got %v, want %v", id, s, want)
+		}
+	}
+	if len(c.samples) != 3 {
+		t.Errorf("got %d samples, want 3: %v", len(c.samples), c.samples)
+	}
+	c.mu.Unlock()
+
+	unknown := -2.0
+	fieldEnumUnknown = &unknown
+	writeLines(t, c, "svc,host=c state=\"paused\"\n")
+	waitForSamples(t, c, 4)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.samples["svc_state.host.c"]; !ok || s.Value != unknown {
+		t.Errorf("unmapped value: got %v, want %v", s, unknown)
+	}
+
+	for _, bad := range []string{"running", "=1", "running=x"} {
+		if _, err := parseEnum(bad); err == nil {
+			t.Errorf("parseEnum(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestCompatInfluxQuery(t *testing.T) {
+	defer func(v bool) { *compatInfluxQuery = v }(*compatInfluxQuery)
+	*compatInfluxQuery = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	h := newHandler(c, prometheus.NewRegistry())
+	for q, want := range map[string]string{
+		"SHOW DATABASES": `{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"]}]}]}`,
+		"CREATE DATABASE telegraf; show  databases": `{"results":[{"statement_id":0},{"statement_id":1,"series":[{"name":"databases","columns":["name"]}]}]}`,
+		"": `{"results":[]}`,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/query?q="+url.QueryEscape(q), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: got status %d, want %d", q, rec.Code, http.StatusOK)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("%q: got %s, want %s", q, got, want)
+		}
+	}
+}
+
+func TestFieldHelp(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=5,usage_help=\"CPU usage\",idle=95\ncpu,host=b usage=7\n")
+	waitForSamples(t, c, 3)
+
+	mfs := gather(t, c)
+	if got := findFamily(mfs, "cpu_usage"); got.GetHelp() != "CPU usage" || len(got.Metric) != 2 {
+		t.Errorf("got cpu_usage %v, want help \"CPU usage\" and 2 series", got)
+	}
+	if got := findFamily(mfs, "cpu_idle").GetHelp(); got != defaultHelp {
+		t.Errorf("got cpu_idle help %q, want %q", got, defaultHelp)
+	}
+	if findFamily(mfs, "cpu_usage_help") != nil {
+		t.Error("help field exported as a metric")
+	}
+}
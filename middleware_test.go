@@ -0,0 +1,123 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use as a log destination.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	defer func(v bool) { *logRequests = v }(*logRequests)
+	*logRequests = true
+
+	var logs syncBuffer
+	c := newInfluxDBCollector(log.NewLogfmtLogger(&logs))
+	req := httptest.NewRequest("POST", "/write?db=telegraf", strings.NewReader("cpu,secret=body value=1\n"))
+	newHandler(c, prometheus.NewRegistry()).ServeHTTP(httptest.NewRecorder(), req)
+
+	got := logs.String()
+	for _, want := range []string{`msg="HTTP request"`, "method=POST", "path=/write", "status=204", "remote=192.0.2.1:1234"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log %q does not contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("log %q contains the request body", got)
+	}
+}
+
+func TestHTTPRequestsCounter(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	h := newHandler(c, prometheus.NewRegistry())
+
+	count := func(path, code string) float64 {
+		return counterValue(t, httpRequests.WithLabelValues(path, code))
+	}
+	before204, before400, beforeNotFound := count("/write", "204"), count("/write", "400"), count("/", "404")
+
+	for _, body := range []string{"cpu value=1\n", "cpu value=\n"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/write", strings.NewReader(body)))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+
+	if got := count("/write", "204") - before204; got != 1 {
+		t.Errorf("got %v requests with 204, want 1", got)
+	}
+	if got := count("/write", "400") - before400; got != 1 {
+		t.Errorf("got %v requests with 400, want 1", got)
+	}
+	if got := count("/", "404") - beforeNotFound; got != 1 {
+		t.Errorf("got %v unknown path requests with 404, want 1", got)
+	}
+}
+
+func TestStatusRecorderFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	var rw http.ResponseWriter = &statusRecorder{ResponseWriter: w}
+	f, ok := rw.(http.Flusher)
+	if !ok {
+		t.Fatal("statusRecorder does not implement http.Flusher")
+	}
+	f.Flush()
+	if !w.Flushed {
+		t.Error("flush was not passed on to the wrapped writer")
+	}
+}
+
+func TestMaxRequestSizeClosesConnection(t *testing.T) {
+	defer func(n int64) { *maxRequestSize = n }(*maxRequestSize)
+	*maxRequestSize = 16
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	srv := httptest.NewServer(newHandler(c, prometheus.NewRegistry()))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/write", "text/plain", strings.NewReader(strings.Repeat("cpu value=1\n", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if !resp.Close {
+		t.Error("connection kept open after an oversized body")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// nameCache is an LRU mapping raw names to the result of ReplaceInvalidChars.
+// It is safe for concurrent use.
+type nameCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type nameEntry struct {
+	raw, sanitized string
+}
+
+func newNameCache(size int) *nameCache {
+	return &nameCache{
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// sanitize returns raw with invalid characters replaced.
+func (n *nameCache) sanitize(raw string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if e, ok := n.entries[raw]; ok {
+		n.lru.MoveToFront(e)
+		return e.Value.(*nameEntry).sanitized
+	}
+
+	sanitized := raw
+	ReplaceInvalidChars(&sanitized)
+	n.entries[raw] = n.lru.PushFront(&nameEntry{raw: raw, sanitized: sanitized})
+	for n.lru.Len() > n.size {
+		oldest := n.lru.Back()
+		n.lru.Remove(oldest)
+		delete(n.entries, oldest.Value.(*nameEntry).raw)
+	}
+	return sanitized
+}
+
+// nameCollisions detects different raw metric names that sanitize to the
+// same name, as their samples would be merged into one metric. Only the size
+// most recently seen sanitized names are remembered. It is safe for
+// concurrent use.
+type nameCollisions struct {
+	mu      sync.Mutex
+	logger  log.Logger
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type collisionEntry struct {
+	sanitized string
+	// First raw name seen for sanitized.
+	raw string
+	// Raw names whose collision was already reported.
+	reported map[string]bool
+}
+
+func newNameCollisions(size int, logger log.Logger) *nameCollisions {
+	return &nameCollisions{
+		logger:  logger,
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// check records that raw was sanitized to sanitized, counting and logging
+// the first time it collides with another raw name.
+func (n *nameCollisions) check(raw, sanitized string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	e, ok := n.entries[sanitized]
+	if !ok {
+		n.entries[sanitized] = n.lru.PushFront(&collisionEntry{sanitized: sanitized, raw: raw})
+		for n.lru.Len() > n.size {
+			oldest := n.lru.Back()
+			n.lru.Remove(oldest)
+			delete(n.entries, oldest.Value.(*collisionEntry).sanitized)
+		}
+		return
+	}
+	n.lru.MoveToFront(e)
+	entry := e.Value.(*collisionEntry)
+	if entry.raw == raw || entry.reported[raw] {
+		return
+	}
+	if entry.reported == nil {
+		entry.reported = map[string]bool{}
+	}
+	entry.reported[raw] = true
+	nameCollisionsTotal.Inc()
+	level.Warn(n.logger).Log("msg", "Different names are sanitized to the same metric name", "name", sanitized, "raw", entry.raw, "colliding_raw", raw)
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ndjsonRecord is a single sample in newline-delimited JSON input.
+type ndjsonRecord struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     *float64          `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// parseNDJSON parses newline-delimited JSON records into samples. Timestamps
+// are in the given precision, and records without one get defaultTime.
+func (c *influxDBCollector) parseNDJSON(buf []byte, defaultTime time.Time, precision string) ([]*influxDBSample, error) {
+	var samples []*influxDBSample
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	for i := 1; ; i++ {
+		var r ndjsonRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %s", i, err)
+		}
+		if r.Name == "" {
+			return nil, fmt.Errorf("record %d: missing name", i)
+		}
+		if r.Value == nil {
+			return nil, fmt.Errorf("record %d: missing value", i)
+		}
+
+		if *strictNames {
+			names := []string{r.Name}
+			for k := range r.Labels {
+				names = append(names, k)
+			}
+			if invalid := invalidName(names); invalid != "" {
+				level.Warn(c.logger).Log("msg", "rejecting record with invalid name", "name", invalid)
+				invalidNamePoints.Inc()
+				continue
+			}
+		}
+
+		sample := &influxDBSample{
+			Name:        c.metricName(r.Name),
+			Measurement: r.Name,
+			Labels:      make(map[string]string, len(r.Labels)),
+			Value:       *r.Value,
+			ValueType:   prometheus.UntypedValue,
+			Timestamp:   defaultTime,
+		}
+		if r.Timestamp != 0 {
+			ts, err := models.SafeCalcTime(r.Timestamp, precision)
+			if err != nil {
+				level.Warn(c.logger).Log("msg", "Dropping record with out of range timestamp", "timestamp", r.Timestamp, "err", err)
+				outOfRangePoints.Inc()
+				continue
+			}
+			sample.Timestamp = ts
+		}
+		sample.Timestamp = roundTimestamp(sample.Timestamp)
+		for k, v := range r.Labels {
+			if k != "" {
+				c.addLabel(sample.Labels, k, v)
+			}
+		}
+		if !limitLabels(sample.Labels) {
+			continue
+		}
+		sample.ID = sampleID(sample.Name, sample.Labels)
+		samples = append(samples, sample)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestInputFormatNDJSON(t *testing.T) {
+	defer func(v string) { *inputFormat = v }(*inputFormat)
+	*inputFormat = "ndjson"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	body := `{"name": "http.requests", "labels": {"code": "200", "host-name": "a"}, "value": 12, "timestamp": 1600000000000}
+{"name": "temperature", "value": -3.5}
+`
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write?precision=ms", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	waitForSamples(t, c, 2)
+
+	c.mu.Lock()
+	requests := c.samples["http_requests.code.200.host_name.a"]
+	temperature := c.samples["temperature"]
+	c.mu.Unlock()
+	if requests == nil || temperature == nil {
+		t.Fatalf("got samples %v", sampleNames(c))
+	}
+	if requests.Value != 12 || !requests.Timestamp.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("got value %v at %v, want 12 at 1600000000", requests.Value, requests.Timestamp)
+	}
+	if temperature.Value != -3.5 || temperature.Timestamp.IsZero() {
+		t.Errorf("got value %v at %v, want -3.5 now", temperature.Value, temperature.Timestamp)
+	}
+
+	rec = httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader(`{"name": "cpu"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a record without value, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDropEmptyLabels(t *testing.T) {
+	defer func(v string, d bool, r []string) { *inputFormat, *dropEmptyLabels, *requiredLabels = v, d, r }(*inputFormat, *dropEmptyLabels, *requiredLabels)
+	*inputFormat = "ndjson"
+	*dropEmptyLabels = true
+	*requiredLabels = []string{"host"}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, missingLabelSamples)
+	body := `{"name": "cpu", "labels": {"host": "a", "zone": "", "rack": "NaN"}, "value": 1}
+{"name": "mem", "labels": {"host": "", "zone": "b"}, "value": 2}
+`
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	waitForSamples(t, c, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) != 1 || c.samples["cpu.host.a"] == nil {
+		t.Errorf("got samples %v, want only cpu.host.a", c.samples)
+	}
+	if got := counterValue(t, missingLabelSamples) - before; got != 1 {
+		t.Errorf("got %v samples missing a required label, want 1", got)
+	}
+}
+
+func TestNDJSONReservedLabel(t *testing.T) {
+	defer func(v string) { *inputFormat = v }(*inputFormat)
+	*inputFormat = "ndjson"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write", strings.NewReader(`{"name": "cpu", "labels": {"--foo": "a"}, "value": 1}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	waitForSamples(t, c, 1)
+
+	rec = scrape(t, c, "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if want := `cpu{key___foo="a"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("got %q, want it to contain %q", rec.Body, want)
+	}
+}
+
+func TestNDJSONTimestampOutOfRange(t *testing.T) {
+	defer func(v string) { *inputFormat = v }(*inputFormat)
+	*inputFormat = "ndjson"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	before := counterValue(t, outOfRangePoints)
+	body := `{"name": "overflow", "value": 1, "timestamp": 9223372036854775}
+{"name": "ok", "value": 2, "timestamp": 1600000000}
+`
+	rec := httptest.NewRecorder()
+	c.influxDBPost(rec, httptest.NewRequest("POST", "/write?precision=s", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	waitForSamples(t, c, 1)
+
+	if got, want := sampleNames(c), []string{"ok"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+	if got := counterValue(t, outOfRangePoints) - before; got != 1 {
+		t.Errorf("got %v out of range records, want 1", got)
+	}
+}
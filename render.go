@@ -0,0 +1,439 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// metricsFormats are the exposition formats --web.format-version can pin.
+var metricsFormats = map[string]expfmt.Format{
+	"text-0.0.4":         expfmt.FmtText,
+	"openmetrics-0.0.1":  expfmt.FmtOpenMetrics,
+	"protobuf-delimited": expfmt.FmtProtoDelim,
+	"protobuf-text":      expfmt.FmtProtoText,
+	"protobuf-compact":   expfmt.FmtProtoCompact,
+}
+
+// metricsHandler serves the metrics gathered from reg, in the format pinned
+// by --web.format-version or negotiated with the scraper otherwise.
+func metricsHandler(reg prometheus.Gatherer, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := reg.Gather()
+		if err != nil {
+			http.Error(w, "error gathering metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if v := r.URL.Query().Get("shard"); v != "" {
+			shard, err := strconv.Atoi(v)
+			if err != nil || shard < 0 || shard >= *outputShards {
+				http.Error(w, fmt.Sprintf("invalid shard %q, must be between 0 and %d", v, *outputShards-1), http.StatusBadRequest)
+				return
+			}
+			mfs = shardFamilies(mfs, shard, *outputShards)
+		}
+
+		// Gather returns the families sorted by name and their metrics sorted
+		// by labels, so the output is stable regardless of map iteration.
+		if *familyMaxSeries > 0 {
+			limitFamilySeries(mfs, *familyMaxSeries, logger)
+		}
+		if *sortByTime {
+			sortSeriesByTime(mfs)
+		}
+		if *omitHelp {
+			for _, mf := range mfs {
+				mf.Help = nil
+			}
+		}
+
+		format, ok := metricsFormats[*formatVersion]
+		if !ok {
+			format = expfmt.Negotiate(r.Header)
+		}
+
+		ctx := r.Context()
+		if *renderTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *renderTimeout)
+			defer cancel()
+		}
+
+		// Encode into a buffer first so that errors can still be reported
+		// with a proper status code.
+		var buf bytes.Buffer
+		if err := encodeFamilies(ctx, &buf, format, mfs, logger); err == context.DeadlineExceeded {
+			level.Warn(logger).Log("msg", "Rendering metrics timed out", "timeout", *renderTimeout)
+			renderTimeouts.Inc()
+			http.Error(w, "rendering metrics timed out", http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, "error encoding metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		scrapeSamples.Set(float64(countSamples(mfs)))
+
+		contentType := string(format)
+		if *contentTypeOverride != "" {
+			contentType = *contentTypeOverride
+		}
+		w.Header().Set("Content-Type", contentType)
+		if gzipAccepted(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			gz.Write(buf.Bytes())
+			return
+		}
+		w.Write(buf.Bytes())
+	})
+}
+
+// maxAgeHandler serves metrics like metricsHandler. If the request has a
+// max_age query parameter, samples of c with a timestamp older than that are
+// left out of the response, without removing them from the store.
+func maxAgeHandler(c *influxDBCollector, reg prometheus.Gatherer, logger log.Logger) http.Handler {
+	metrics := metricsHandler(reg, logger)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query().Get("max_age")
+		if v == "" {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		age, err := model.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid max_age: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		metricsHandler(maxAgeGatherer{reg, c, time.Duration(age)}, logger).ServeHTTP(w, r)
+	})
+}
+
+// maxAgeGatherer drops the metrics of samples older than maxAge from what
+// the wrapped Gatherer returns. Metrics that are not backed by a stored
+// sample, like the exporter's own, are kept.
+type maxAgeGatherer struct {
+	prometheus.Gatherer
+	c      *influxDBCollector
+	maxAge time.Duration
+}
+
+func (g maxAgeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	limit := time.Now().Add(-g.maxAge)
+
+	g.c.mu.Lock()
+	defer g.c.mu.Unlock()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label))
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if s := g.c.lookupSample(mf.GetName(), labels); s != nil && limit.After(s.Timestamp) {
+				continue
+			}
+			metrics = append(metrics, m)
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			kept = append(kept, mf)
+		}
+	}
+	return kept, nil
+}
+
+// shardOf returns the shard of a metric family name out of shards.
+func shardOf(name string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardFamilies returns the families that belong to shard.
+func shardFamilies(mfs []*dto.MetricFamily, shard, shards int) []*dto.MetricFamily {
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		if shardOf(mf.GetName(), shards) == shard {
+			kept = append(kept, mf)
+		}
+	}
+	return kept
+}
+
+// checkContentType validates a --export.content-type override against the
+// format pinned by --web.format-version. The media types must match, and
+// protobuf overrides must name the same encoding.
+func checkContentType(override, version string) error {
+	format, ok := metricsFormats[version]
+	if !ok {
+		return fmt.Errorf("a content type override requires a fixed format, not %q", version)
+	}
+	got, gotParams, err := mime.ParseMediaType(override)
+	if err != nil {
+		return err
+	}
+	want, wantParams, _ := mime.ParseMediaType(string(format))
+	if got != want {
+		return fmt.Errorf("media type %q does not match %q of format %s", got, want, version)
+	}
+	if gotParams["encoding"] != wantParams["encoding"] {
+		return fmt.Errorf("encoding %q does not match %q of format %s", gotParams["encoding"], wantParams["encoding"], version)
+	}
+	return nil
+}
+
+// warmupHandler answers with 503 until the given time, so that scrapers do
+// not see series as missing while clients have not pushed yet.
+func warmupHandler(h http.Handler, until time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := time.Until(until); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+			http.Error(w, "exporter is starting up", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitFamilySeries drops all but the first max series of each family. As
+// gathered metrics are sorted by labels, the same series are kept every time.
+func limitFamilySeries(mfs []*dto.MetricFamily, max int, logger log.Logger) {
+	for _, mf := range mfs {
+		if len(mf.Metric) > max {
+			level.Warn(logger).Log("msg", "Dropping series exceeding the family limit", "name", mf.GetName(), "series", len(mf.Metric), "limit", max)
+			mf.Metric = mf.Metric[:max]
+		}
+	}
+}
+
+// sortSeriesByTime orders the series of each family by timestamp, keeping
+// the label order for equal timestamps. Series without a timestamp come first.
+func sortSeriesByTime(mfs []*dto.MetricFamily) {
+	for _, mf := range mfs {
+		sort.SliceStable(mf.Metric, func(i, j int) bool {
+			return mf.Metric[i].GetTimestampMs() < mf.Metric[j].GetTimestampMs()
+		})
+	}
+}
+
+// countSamples returns the number of samples in the families as Prometheus
+// counts them, i.e. a sample per bucket or quantile, plus the sum and count,
+// for histograms and summaries.
+func countSamples(mfs []*dto.MetricFamily) int {
+	var n int
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			switch {
+			case m.Histogram != nil:
+				n += len(m.Histogram.Bucket) + 2
+				if !hasInfBucket(m.Histogram) {
+					n++
+				}
+			case m.Summary != nil:
+				n += len(m.Summary.Quantile) + 2
+			default:
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// hasInfBucket reports whether a histogram has an explicit +Inf bucket.
+func hasInfBucket(h *dto.Histogram) bool {
+	b := h.Bucket
+	return len(b) > 0 && math.IsInf(b[len(b)-1].GetUpperBound(), 1)
+}
+
+// encodeFamilies writes the families to w in the given format, including any
+// trailer the format needs. Families that fail to encode are logged, counted
+// and left out without leaving partial output behind. Encoding stops with the
+// context's error once it is done.
+func encodeFamilies(ctx context.Context, w io.Writer, format expfmt.Format, mfs []*dto.MetricFamily, logger log.Logger) error {
+	var family bytes.Buffer
+	enc := expfmt.NewEncoder(&family, format)
+	for _, mf := range mfs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		family.Reset()
+		if err := enc.Encode(mf); err != nil {
+			level.Error(logger).Log("msg", "Error encoding metric family", "name", mf.GetName(), "err", err)
+			encodeErrors.Inc()
+			continue
+		}
+		out := family.Bytes()
+		if format == expfmt.FmtOpenMetrics {
+			out = addUnit(out, mf)
+		}
+		if *integerFormat != "shortest" && (format == expfmt.FmtText || format == expfmt.FmtOpenMetrics) {
+			out = formatIntegers(out, *integerFormat == "decimal")
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+
+	family.Reset()
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(family.Bytes())
+	return err
+}
+
+// metricUnits maps the names of metrics that got a unit from --schema.file or
+// --name.unit-normalize to the unit.
+var metricUnits = struct {
+	sync.RWMutex
+	units map[string]string
+}{units: map[string]string{}}
+
+// setMetricUnit records the unit a metric name got.
+func setMetricUnit(name, unit string) {
+	metricUnits.RLock()
+	known := metricUnits.units[name] == unit
+	metricUnits.RUnlock()
+	if !known {
+		metricUnits.Lock()
+		metricUnits.units[name] = unit
+		metricUnits.Unlock()
+	}
+}
+
+// addUnit adds a # UNIT line after the # TYPE line of an OpenMetrics family
+// that got a unit from --schema.file or --name.unit-normalize. The encoder
+// can't write it, as metric families do not carry a unit.
+func addUnit(family []byte, mf *dto.MetricFamily) []byte {
+	metricUnits.RLock()
+	unit := metricUnits.units[mf.GetName()]
+	metricUnits.RUnlock()
+	// Like the encoder, strip the _total suffix of counters.
+	name := mf.GetName()
+	if mf.GetType() == dto.MetricType_COUNTER {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	typeLine := []byte("# TYPE " + name + " ")
+	i := bytes.Index(family, typeLine)
+	if unit == "" || i < 0 {
+		return family
+	}
+	end := i + bytes.IndexByte(family[i:], '\n') + 1
+	out := make([]byte, 0, len(family)+len(name)+len(unit)+9)
+	out = append(out, family[:end]...)
+	out = append(out, "# UNIT "+name+" "+unit+"\n"...)
+	return append(out, family[end:]...)
+}
+
+// formatIntegers rewrites the whole number sample values of a text format
+// family with all their digits, and with a ".0" suffix if decimal is set.
+// Values of a magnitude where 'g' formatting is the only readable choice are
+// left alone.
+func formatIntegers(family []byte, decimal bool) []byte {
+	var out []byte
+	for _, line := range bytes.SplitAfter(family, []byte{'\n'}) {
+		start, end := sampleValue(line)
+		if start < 0 {
+			out = append(out, line...)
+			continue
+		}
+		v, err := strconv.ParseFloat(string(line[start:end]), 64)
+		if err != nil || v != math.Trunc(v) || math.Abs(v) >= 1e21 {
+			out = append(out, line...)
+			continue
+		}
+		out = append(out, line[:start]...)
+		out = strconv.AppendFloat(out, v, 'f', -1, 64)
+		if decimal {
+			out = append(out, ".0"...)
+		}
+		out = append(out, line[end:]...)
+	}
+	return out
+}
+
+// sampleValue returns the bounds of the value of a text format sample line,
+// or -1 for comments and blank lines. Label values are quoted and may contain
+// spaces and braces.
+func sampleValue(line []byte) (int, int) {
+	if len(line) == 0 || line[0] == '#' || line[0] == '\n' {
+		return -1, -1
+	}
+	i := bytes.IndexAny(line, " {")
+	if i < 0 {
+		return -1, -1
+	}
+	if line[i] == '{' {
+		quoted := false
+		for i++; i < len(line) && (quoted || line[i] != '}'); i++ {
+			if line[i] == '\\' && quoted {
+				i++
+			} else if line[i] == '"' {
+				quoted = !quoted
+			}
+		}
+		i++
+	}
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	end := i
+	for end < len(line) && line[end] != ' ' && line[end] != '\n' {
+		end++
+	}
+	if end == i {
+		return -1, -1
+	}
+	return i, end
+}
+
+// gzipAccepted reports whether the client accepts gzip encoded responses.
+func gzipAccepted(header http.Header) bool {
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,469 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrape renders the collector's metrics through the metrics handler.
+func scrape(t *testing.T, c *influxDBCollector, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	rec := httptest.NewRecorder()
+	metricsHandler(reg, log.NewNopLogger()).ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	return rec
+}
+
+func TestFormatVersion(t *testing.T) {
+	defer func(v string) { *formatVersion = v }(*formatVersion)
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu value=1\n")
+	waitForSamples(t, c, 1)
+
+	for version, want := range map[string]string{
+		"negotiate":          "text/plain; version=0.0.4; charset=utf-8",
+		"text-0.0.4":         "text/plain; version=0.0.4; charset=utf-8",
+		"openmetrics-0.0.1":  "application/openmetrics-text; version=0.0.1; charset=utf-8",
+		"protobuf-delimited": "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+	} {
+		*formatVersion = version
+		rec := scrape(t, c, "/metrics")
+		if rec.Code != 200 {
+			t.Errorf("%s: got status %d, want 200", version, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: got Content-Type %q, want %q", version, got, want)
+		}
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "mem used=1,free=2\ncpu,core=1 usage=3\ncpu,core=0 usage=4\ndisk,path=/ used=5,free=6\n")
+	waitForSamples(t, c, 6)
+
+	first := scrape(t, c, "/metrics").Body.String()
+	for i := 0; i < 10; i++ {
+		if got := scrape(t, c, "/metrics").Body.String(); got != first {
+			t.Fatalf("output changed between scrapes:\n%s\nvs\n%s", first, got)
+		}
+	}
+
+	var names []string
+	for _, line := range strings.Split(first, "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			names = append(names, strings.Fields(line)[2])
+		}
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("families not sorted by name: %v", names)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	before := counterValue(t, encodeErrors)
+	mfs := []*dto.MetricFamily{
+		{
+			Name:   proto.String("bad"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		},
+		{
+			Name:   proto.String("good"),
+			Type:   dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(2)}}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := encodeFamilies(context.Background(), &buf, expfmt.FmtText, mfs, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "# TYPE good untyped\ngood 2\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	if got := counterValue(t, encodeErrors) - before; got != 1 {
+		t.Errorf("got %v encode errors, want 1", got)
+	}
+}
+
+func TestTextTimestampMilliseconds(t *testing.T) {
+	defer func(v string, ts bool) { *formatVersion, *exportTimestamp = v, ts }(*formatVersion, *exportTimestamp)
+	*formatVersion = "text-0.0.4"
+	*exportTimestamp = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	// Sub-millisecond precision is truncated, not rounded.
+	ts := time.Now().Truncate(time.Second).Add(123999999 * time.Nanosecond)
+	writeLines(t, c, fmt.Sprintf("cpu value=5 %d\n", ts.UnixNano()))
+	waitForSamples(t, c, 1)
+
+	body := scrape(t, c, "/metrics").Body.String()
+	if want := fmt.Sprintf("\ncpu 5 %d\n", ts.Unix()*1000+123); !strings.Contains(body, want) {
+		t.Errorf("output %q does not contain %q", body, want)
+	}
+}
+
+func TestFamilyMaxSeries(t *testing.T) {
+	defer func(n int) { *familyMaxSeries = n }(*familyMaxSeries)
+	*familyMaxSeries = 2
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,core=3 usage=1\ncpu,core=1 usage=1\ncpu,core=2 usage=1\nmem used=1\n")
+	waitForSamples(t, c, 4)
+
+	body := scrape(t, c, "/metrics").Body.String()
+	for _, want := range []string{`cpu_usage{core="1"} 1`, `cpu_usage{core="2"} 1`, "mem_used 1"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("output does not contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `core="3"`) {
+		t.Errorf("output contains series beyond the limit:\n%s", body)
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	defer func(d time.Duration) { *startupDelay = d }(*startupDelay)
+	*startupDelay = 100 * time.Millisecond
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	h := newHandler(c, prometheus.NewRegistry())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", *metricsPath, nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d during startup delay, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	time.Sleep(*startupDelay)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", *metricsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d after startup delay, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	defer func(d time.Duration) { *renderTimeout = d }(*renderTimeout)
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	var lines strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&lines, "m%d,host=a value=%d\n", i, i)
+	}
+	writeLines(t, c, lines.String())
+	waitForSamples(t, c, 5000)
+
+	*renderTimeout = time.Nanosecond
+	before := counterValue(t, renderTimeouts)
+	if rec := scrape(t, c, "/metrics"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := counterValue(t, renderTimeouts) - before; got != 1 {
+		t.Errorf("got %v render timeouts, want 1", got)
+	}
+
+	*renderTimeout = time.Minute
+	if rec := scrape(t, c, "/metrics"); rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestOpenMetricsEOF(t *testing.T) {
+	defer func(v string) { *formatVersion = v }(*formatVersion)
+	*formatVersion = "openmetrics-0.0.1"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "mem used=1,free=2\ncpu,core=1 usage=3\ndisk,path=/ used=5\n")
+	waitForSamples(t, c, 4)
+
+	body := scrape(t, c, "/metrics").Body.String()
+	if got := strings.Count(body, "# EOF"); got != 1 {
+		t.Errorf("got %d # EOF lines, want 1:\n%s", got, body)
+	}
+	if !strings.HasSuffix(body, "\n# EOF\n") {
+		t.Errorf("output does not end with # EOF:\n%s", body)
+	}
+}
+
+func TestSortByTime(t *testing.T) {
+	defer func(v, e bool) { *sortByTime, *exportTimestamp = v, e }(*sortByTime, *exportTimestamp)
+	*sortByTime = true
+	*exportTimestamp = true
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	now := time.Now().Truncate(time.Second)
+	writeLines(t, c, fmt.Sprintf("cpu,host=a value=1 %d\ncpu,host=b value=2 %d\ncpu,host=c value=3 %d\n",
+		now.UnixNano(), now.Add(-2*time.Second).UnixNano(), now.Add(-time.Second).UnixNano()))
+	waitForSamples(t, c, 3)
+
+	var hosts []string
+	for _, line := range strings.Split(scrape(t, c, "/metrics").Body.String(), "\n") {
+		if strings.HasPrefix(line, "cpu{") {
+			hosts = append(hosts, line[len(`cpu{host="`):len(`cpu{host="`)+1])
+		}
+	}
+	if got, want := strings.Join(hosts, ","), "b,c,a"; got != want {
+		t.Errorf("got hosts in order %s, want %s", got, want)
+	}
+}
+
+func TestScrapeSamples(t *testing.T) {
+	defer func(v map[string]float64) { summaryQuantiles = v }(summaryQuantiles)
+	summaryQuantiles = map[string]float64{"p50": 0.5, "p99": 0.99}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a value=1\ncpu,host=b value=2\nlatency p50=1,p99=2,count=3i,sum=4\n")
+	waitForSamples(t, c, 3)
+
+	var rendered int
+	for _, line := range strings.Split(scrape(t, c, "/metrics").Body.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			rendered++
+		}
+	}
+	if got := gaugeValue(t, scrapeSamples); got != float64(rendered) {
+		t.Errorf("got %v scrape samples, want %d", got, rendered)
+	}
+}
+
+func TestContentTypeOverride(t *testing.T) {
+	defer func(v, f string) { *contentTypeOverride, *formatVersion = v, f }(*contentTypeOverride, *formatVersion)
+	*formatVersion = "text-0.0.4"
+	*contentTypeOverride = "text/plain; version=0.0.4"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	rec := scrape(t, c, "/metrics")
+	if got := rec.Header().Get("Content-Type"); got != *contentTypeOverride {
+		t.Errorf("got Content-Type %q, want %q", got, *contentTypeOverride)
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE influxdb_last_push_timestamp_seconds gauge") {
+		t.Errorf("body is not in the text format:\n%s", rec.Body)
+	}
+
+	for _, tc := range []struct {
+		override, version string
+		valid             bool
+	}{
+		{"text/plain", "text-0.0.4", true},
+		{"text/plain; charset=utf-8", "text-0.0.4", true},
+		{"application/openmetrics-text", "openmetrics-0.0.1", true},
+		{"application/vnd.google.protobuf; encoding=delimited", "protobuf-delimited", true},
+		{"text/plain", "negotiate", false},
+		{"application/openmetrics-text", "text-0.0.4", false},
+		{"application/vnd.google.protobuf; encoding=text", "protobuf-delimited", false},
+		{"not a media type;", "text-0.0.4", false},
+	} {
+		if err := checkContentType(tc.override, tc.version); (err == nil) != tc.valid {
+			t.Errorf("%q with %s: got error %v, want valid %v", tc.override, tc.version, err, tc.valid)
+		}
+	}
+}
+
+func TestMaxAgeParam(t *testing.T) {
+	c := newInfluxDBCollector(log.NewNopLogger())
+	now := time.Now()
+	writeLines(t, c, fmt.Sprintf("cpu,host=old usage=1 %d\ncpu,host=new usage=2 %d\n", now.Add(-time.Minute).UnixNano(), now.UnixNano()))
+	waitForSamples(t, c, 2)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	h := newHandler(c, reg)
+	scrape := func(target string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	_, body := scrape(*metricsPath)
+	if !strings.Contains(body, `host="old"`) || !strings.Contains(body, `host="new"`) {
+		t.Errorf("output without max_age is missing series:\n%s", body)
+	}
+
+	_, body = scrape(*metricsPath + "?max_age=30s")
+	if strings.Contains(body, `host="old"`) || !strings.Contains(body, `host="new"`) {
+		t.Errorf("output with max_age=30s should only have the new series:\n%s", body)
+	}
+	if !strings.Contains(body, "influxdb_last_push_timestamp_seconds") {
+		t.Errorf("output with max_age=30s is missing metrics without a sample:\n%s", body)
+	}
+
+	// The old sample is still stored.
+	_, body = scrape(*metricsPath)
+	if !strings.Contains(body, `host="old"`) {
+		t.Errorf("max_age removed a sample from the store:\n%s", body)
+	}
+
+	if code, _ := scrape(*metricsPath + "?max_age=soon"); code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid max_age, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestOpenMetricsUnit(t *testing.T) {
+	defer func(v string, n bool, u []unitSuffix) { *formatVersion, *unitNormalize, unitSuffixes = v, n, u }(*formatVersion, *unitNormalize, unitSuffixes)
+	*formatVersion = "openmetrics-0.0.1"
+	*unitNormalize = true
+	units, err := parseUnitSuffixes(map[string]string{"ms": "seconds:0.001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unitSuffixes = units
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "http duration_ms=1500,count=3,latency_seconds=2\n")
+	waitForSamples(t, c, 3)
+
+	body := scrape(t, c, "/metrics").Body.String()
+	if !strings.Contains(body, "# TYPE http_duration_seconds unknown\n# UNIT http_duration_seconds seconds\n") {
+		t.Errorf("output has no unit for http_duration_seconds:\n%s", body)
+	}
+	// Metrics that merely end with a unit did not get it from the mapping.
+	for _, name := range []string{"http_count", "http_latency_seconds", "influxdb_last_push_timestamp_seconds"} {
+		if strings.Contains(body, "# UNIT "+name) {
+			t.Errorf("output has a unit for %s:\n%s", name, body)
+		}
+	}
+
+	// The text format has no unit metadata.
+	*formatVersion = "text-0.0.4"
+	if body := scrape(t, c, "/metrics").Body.String(); strings.Contains(body, "# UNIT") {
+		t.Errorf("text output has a unit:\n%s", body)
+	}
+}
+
+func TestIntegerFormat(t *testing.T) {
+	defer func(v, f string) { *integerFormat, *formatVersion = v, f }(*integerFormat, *formatVersion)
+	*formatVersion = "text-0.0.4"
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "disk,path=/a\\ b,note=x}\\ y used=1000000i,free=5i,ratio=0.25\n")
+	waitForSamples(t, c, 3)
+
+	for format, want := range map[string][]string{
+		"shortest": {`disk_used{note="x} y",path="/a b"} 1e+06`, `disk_free{note="x} y",path="/a b"} 5` + "\n", "disk_ratio{note=\"x} y\",path=\"/a b\"} 0.25\n"},
+		"integer":  {`disk_used{note="x} y",path="/a b"} 1000000` + "\n", `disk_free{note="x} y",path="/a b"} 5` + "\n", "disk_ratio{note=\"x} y\",path=\"/a b\"} 0.25\n"},
+		"decimal":  {`disk_used{note="x} y",path="/a b"} 1000000.0` + "\n", `disk_free{note="x} y",path="/a b"} 5.0` + "\n", "disk_ratio{note=\"x} y\",path=\"/a b\"} 0.25\n"},
+	} {
+		*integerFormat = format
+		body := scrape(t, c, "/metrics").Body.String()
+		for _, w := range want {
+			if !strings.Contains(body, w) {
+				t.Errorf("%s: output does not contain %q:\n%s", format, w, body)
+			}
+		}
+	}
+}
+
+func TestOutputShards(t *testing.T) {
+	defer func(v int) { *outputShards = v }(*outputShards)
+	*outputShards = 3
+
+	for _, name := range []string{"cpu_usage", "mem_used", "disk_free"} {
+		shard := shardOf(name, 3)
+		if shard < 0 || shard >= 3 {
+			t.Errorf("%s: got shard %d out of 3", name, shard)
+		}
+		for i := 0; i < 10; i++ {
+			if got := shardOf(name, 3); got != shard {
+				t.Errorf("%s: got shard %d, then %d", name, shard, got)
+			}
+		}
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	var lines strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&lines, "m%d value=%d\n", i, i)
+	}
+	writeLines(t, c, lines.String())
+	waitForSamples(t, c, 20)
+
+	// Every family is in exactly one shard, the one its name hashes to.
+	seen := map[string]int{}
+	for shard := 0; shard < 3; shard++ {
+		rec := scrape(t, c, fmt.Sprintf("/metrics?shard=%d", shard))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("shard %d: got status %d", shard, rec.Code)
+		}
+		mfs, err := new(expfmt.TextParser).TextToMetricFamilies(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name := range mfs {
+			if got := shardOf(name, 3); got != shard {
+				t.Errorf("%s served by shard %d, but hashes to %d", name, shard, got)
+			}
+			seen[name]++
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if name := fmt.Sprintf("m%d", i); seen[name] != 1 {
+			t.Errorf("%s served by %d shards, want 1", name, seen[name])
+		}
+	}
+
+	for _, shard := range []string{"3", "-1", "x"} {
+		if rec := scrape(t, c, "/metrics?shard="+shard); rec.Code != http.StatusBadRequest {
+			t.Errorf("shard %s: got status %d, want %d", shard, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestOmitHelp(t *testing.T) {
+	defer func(v string, o bool) { *formatVersion, *omitHelp = v, o }(*formatVersion, *omitHelp)
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=1\ncpu,host=b usage=2\nmem used=3\n")
+	waitForSamples(t, c, 3)
+
+	for _, format := range []string{"text-0.0.4", "openmetrics-0.0.1"} {
+		*formatVersion = format
+
+		// Each family has its metadata once, however many series it has.
+		*omitHelp = false
+		body := scrape(t, c, "/metrics").Body.String()
+		for _, want := range []string{"# HELP cpu_usage ", "# TYPE cpu_usage ", "# HELP mem_used ", "# TYPE mem_used "} {
+			if got := strings.Count(body, want); got != 1 {
+				t.Errorf("%s: got %d lines starting with %q, want 1:\n%s", format, got, want, body)
+			}
+		}
+
+		*omitHelp = true
+		body = scrape(t, c, "/metrics").Body.String()
+		if strings.Contains(body, "# HELP") {
+			t.Errorf("%s: output has help with --export.omit-help:\n%s", format, body)
+		}
+		if got := strings.Count(body, "# TYPE cpu_usage "); got != 1 {
+			t.Errorf("%s: got %d type lines for cpu_usage, want 1:\n%s", format, got, body)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// schemaField is an entry of --schema.file.
+type schemaField struct {
+	Measurement string `json:"measurement"`
+	Field       string `json:"field"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit"`
+}
+
+// fieldSchema is the parsed type and unit of a field.
+type fieldSchema struct {
+	valueType *prometheus.ValueType
+	unit      string
+}
+
+type schemaKey struct {
+	measurement, field string
+}
+
+// Parsed from --schema.file.
+var schema = map[schemaKey]fieldSchema{}
+
+// loadSchema reads a JSON schema file of the form
+//
+//	{"fields": [{"measurement": "disk", "field": "used", "type": "gauge", "unit": "bytes"}]}
+//
+// Type and unit are both optional.
+func loadSchema(path string) (map[schemaKey]fieldSchema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Fields []schemaField `json:"fields"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[schemaKey]fieldSchema, len(file.Fields))
+	for i, f := range file.Fields {
+		if f.Measurement == "" || f.Field == "" {
+			return nil, fmt.Errorf("field %d: measurement and field are required", i)
+		}
+		var s fieldSchema
+		if f.Type != "" {
+			t, err := parseValueType(f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("field %d: %s", i, err)
+			}
+			s.valueType = &t
+		}
+		if f.Unit != "" {
+			if !model.LabelName(f.Unit).IsValid() || strings.HasPrefix(f.Unit, "_") {
+				return nil, fmt.Errorf("field %d: invalid unit %q", i, f.Unit)
+			}
+			s.unit = f.Unit
+		}
+		fields[schemaKey{f.Measurement, f.Field}] = s
+	}
+	return fields, nil
+}
+
+// addSchemaUnit appends the unit to a metric name unless it already ends with
+// it.
+func addSchemaUnit(name, unit string) string {
+	if strings.HasSuffix(name, "_"+unit) {
+		return name
+	}
+	return name + "_" + unit
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSchemaFile(t *testing.T) {
+	defer func(s map[schemaKey]fieldSchema, f string) { schema, *formatVersion = s, f }(schema, *formatVersion)
+
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(path, []byte(`{"fields": [
+		{"measurement": "net", "field": "bytes_recv", "type": "counter"},
+		{"measurement": "disk", "field": "used", "type": "gauge", "unit": "bytes"}
+	]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := loadSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema = fields
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "net bytes_recv=100i,drops=1i\ndisk used=5i\nmem used=6i\n")
+	waitForSamples(t, c, 4)
+
+	mfs := gather(t, c)
+	for name, want := range map[string]dto.MetricType{
+		"net_bytes_recv":  dto.MetricType_COUNTER,
+		"disk_used_bytes": dto.MetricType_GAUGE,
+		// Fields that are not in the schema are inferred as usual.
+		"net_drops": dto.MetricType_UNTYPED,
+		"mem_used":  dto.MetricType_UNTYPED,
+	} {
+		mf := findFamily(mfs, name)
+		if mf == nil {
+			t.Errorf("%s not found", name)
+			continue
+		}
+		if mf.GetType() != want {
+			t.Errorf("%s: got type %v, want %v", name, mf.GetType(), want)
+		}
+	}
+
+	*formatVersion = "openmetrics-0.0.1"
+	if body := scrape(t, c, "/metrics").Body.String(); !strings.Contains(body, "# UNIT disk_used_bytes bytes\n") {
+		t.Errorf("output has no unit for disk_used_bytes:\n%s", body)
+	}
+
+	for _, bad := range []string{
+		`{"fields": [{"measurement": "disk", "type": "gauge"}]}`,
+		`{"fields": [{"measurement": "disk", "field": "used", "type": "histogram"}]}`,
+		`{"fields": [{"measurement": "disk", "field": "used", "unit": "kilo-bytes"}]}`,
+		`{"fields": `,
+	} {
+		if err := ioutil.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSchema(path); err == nil {
+			t.Errorf("loadSchema(%s) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// hashedSamples stores samples keyed by a hash of their name and labels, so
+// that the joined ID string does not have to be kept. Samples whose hashes
+// collide share a bucket and are told apart by comparing names and labels.
+type hashedSamples map[uint64][]*influxDBSample
+
+// seriesHash returns the FNV-1a hash of a name and its sorted labels.
+func seriesHash(name string, labels map[string]string) uint64 {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	for _, k := range names {
+		h.Write([]byte{0xff})
+		h.Write([]byte(k))
+		h.Write([]byte{0xff})
+		h.Write([]byte(labels[k]))
+	}
+	return h.Sum64()
+}
+
+// sameSeries reports whether two samples have the same name and labels.
+func sameSeries(a, b *influxDBSample) bool {
+	if a.Name != b.Name || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for k, v := range a.Labels {
+		if w, ok := b.Labels[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the stored sample of the same series as s, or nil.
+func (h hashedSamples) get(s *influxDBSample) *influxDBSample {
+	for _, stored := range h[seriesHash(s.Name, s.Labels)] {
+		if sameSeries(stored, s) {
+			return stored
+		}
+	}
+	return nil
+}
+
+// put stores s, returning the sample it replaced, if any.
+func (h hashedSamples) put(s *influxDBSample) *influxDBSample {
+	key := seriesHash(s.Name, s.Labels)
+	bucket := h[key]
+	for i, stored := range bucket {
+		if sameSeries(stored, s) {
+			bucket[i] = s
+			return stored
+		}
+	}
+	h[key] = append(bucket, s)
+	return nil
+}
+
+// remove deletes the stored sample of the same series as s.
+func (h hashedSamples) remove(s *influxDBSample) {
+	key := seriesHash(s.Name, s.Labels)
+	bucket := h[key]
+	for i, stored := range bucket {
+		if sameSeries(stored, s) {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(h, key)
+	} else {
+		h[key] = bucket
+	}
+}
+
+// sampleKey returns the ID of a sample, computing it if it is not stored.
+func sampleKey(s *influxDBSample) string {
+	if s.ID != "" {
+		return s.ID
+	}
+	return sampleID(s.Name, s.Labels)
+}
+
+// storedSamples returns all stored samples. It must be called with mu held.
+func (c *influxDBCollector) storedSamples() []*influxDBSample {
+	if c.hashed != nil {
+		var samples []*influxDBSample
+		for _, bucket := range c.hashed {
+			samples = append(samples, bucket...)
+		}
+		return samples
+	}
+	samples := make([]*influxDBSample, 0, len(c.samples))
+	for _, sample := range c.samples {
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// hasSample reports whether a sample of the same series as s is stored. It
+// must be called with mu held.
+func (c *influxDBCollector) hasSample(s *influxDBSample) bool {
+	if c.hashed != nil {
+		return c.hashed.get(s) != nil
+	}
+	_, ok := c.samples[s.ID]
+	return ok
+}
+
+// lookupSample returns the stored sample of a series, or nil. It must be
+// called with mu held.
+func (c *influxDBCollector) lookupSample(name string, labels map[string]string) *influxDBSample {
+	if c.hashed != nil {
+		return c.hashed.get(&influxDBSample{Name: name, Labels: labels})
+	}
+	return c.samples[sampleID(name, labels)]
+}
+
+// sampleByID returns the stored sample with the given ID, or nil. Hashed
+// samples do not keep their ID, so finding one means scanning the store. It
+// must be called with mu held.
+func (c *influxDBCollector) sampleByID(id string) *influxDBSample {
+	if c.hashed == nil {
+		return c.samples[id]
+	}
+	for _, bucket := range c.hashed {
+		for _, s := range bucket {
+			if sampleKey(s) == id {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// putSample stores s, returning the sample it replaced, if any. It must be
+// called with mu held.
+func (c *influxDBCollector) putSample(s *influxDBSample) *influxDBSample {
+	if c.hashed != nil {
+		// The ID is only needed until the sample is stored.
+		s.ID = ""
+		return c.hashed.put(s)
+	}
+	old := c.samples[s.ID]
+	c.samples[s.ID] = s
+	return old
+}
+
+// removeSample deletes s from the store. It must be called with mu held.
+func (c *influxDBCollector) removeSample(s *influxDBSample) {
+	if c.history != nil {
+		delete(c.history, sampleKey(s))
+	}
+	if c.hashed != nil {
+		c.hashed.remove(s)
+		return
+	}
+	delete(c.samples, s.ID)
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSampleIDHash(t *testing.T) {
+	defer func(v bool, d time.Duration) { *sampleIDHash, *sampleExpiry = v, d }(*sampleIDHash, *sampleExpiry)
+	// The fixture is from 2020, so it must not have expired.
+	*sampleExpiry = time.Since(time.Unix(1500000000, 0))
+
+	buf := telegrafFixture(300)
+	output := func() (string, string) {
+		c := newInfluxDBCollector(log.NewNopLogger())
+		points, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.parsePointsToSample(points)
+		// Samples are processed in order, so all points have been handled
+		// once this one is stored.
+		writeLines(t, c, "done,host=a value=1 1600000000000000000\n")
+		done := &influxDBSample{ID: "done.host.a", Name: "done", Labels: map[string]string{"host": "a"}}
+		for {
+			c.mu.Lock()
+			ok := c.hasSample(done)
+			c.mu.Unlock()
+			if ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		rec := httptest.NewRecorder()
+		c.dump(rec, httptest.NewRequest("GET", "/-/dump", nil))
+		return rec.Body.String(), fmt.Sprint(gather(t, c))
+	}
+
+	wantDump, wantMetrics := output()
+	*sampleIDHash = true
+	gotDump, gotMetrics := output()
+	if gotDump != wantDump {
+		t.Errorf("got dump\n%s\nwant\n%s", gotDump, wantDump)
+	}
+	if gotMetrics != wantMetrics {
+		t.Errorf("got metrics\n%s\nwant\n%s", gotMetrics, wantMetrics)
+	}
+}
+
+func TestHashedSamplesCollision(t *testing.T) {
+	a := &influxDBSample{Name: "cpu", Labels: map[string]string{"host": "a"}, Value: 1}
+	b := &influxDBSample{Name: "cpu", Labels: map[string]string{"host": "b"}, Value: 2}
+
+	// Force both series into the same bucket.
+	key := seriesHash(b.Name, b.Labels)
+	h := hashedSamples{key: {a}}
+	if got := h.get(b); got != nil {
+		t.Errorf("got %v for a colliding series, want nil", got)
+	}
+	if old := h.put(b); old != nil {
+		t.Errorf("put replaced %v, want nil", old)
+	}
+	if len(h[key]) != 2 {
+		t.Fatalf("got %d samples in the bucket, want 2", len(h[key]))
+	}
+
+	b2 := &influxDBSample{Name: "cpu", Labels: map[string]string{"host": "b"}, Value: 3}
+	if old := h.put(b2); old != b {
+		t.Errorf("put replaced %v, want %v", old, b)
+	}
+	h.remove(b2)
+	if !reflect.DeepEqual(h[key], []*influxDBSample{a}) {
+		t.Errorf("got bucket %v after remove, want only %v", h[key], a)
+	}
+}
+
+func benchmarkStore(b *testing.B, hashed bool) {
+	defer func(v bool) { *sampleIDHash = v }(*sampleIDHash)
+	*sampleIDHash = hashed
+
+	const series = 100000
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		c := &influxDBCollector{samples: map[string]*influxDBSample{}, measurements: map[string]int{}}
+		if hashed {
+			c.hashed = hashedSamples{}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for j := 0; j < series; j++ {
+			labels := map[string]string{"host": fmt.Sprintf("server%05d", j), "region": "eu-west-1", "service": "frontend"}
+			c.putSample(&influxDBSample{
+				ID:        sampleID("http_requests_total", labels),
+				Name:      "http_requests_total",
+				Labels:    labels,
+				ValueType: prometheus.CounterValue,
+			})
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/series, "B/series")
+		runtime.KeepAlive(c)
+	}
+}
+
+func BenchmarkStoreStringIDs(b *testing.B) { benchmarkStore(b, false) }
+func BenchmarkStoreHashedIDs(b *testing.B) { benchmarkStore(b, true) }
@@ -0,0 +1,273 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// vmBatchBytes is the uncompressed size above which a push is split.
+	vmBatchBytes   = 1 << 20
+	vmPushAttempts = 3
+	vmPushTimeout  = 10 * time.Second
+)
+
+// routeCollector exports the samples of a collector whose measurement
+// matches a route.
+type routeCollector struct {
+	c     *influxDBCollector
+	match func(measurement string) bool
+}
+
+// Describe implements prometheus.Collector. Nothing is described, as the
+// exported metrics depend on the samples.
+func (r routeCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (r routeCollector) Collect(ch chan<- prometheus.Metric) {
+	r.c.mu.Lock()
+	var samples []*influxDBSample
+	for _, s := range r.c.storedSamples() {
+		if r.match(s.Measurement) {
+			samples = append(samples, s)
+		}
+	}
+	r.c.mu.Unlock()
+	collectSamples(ch, samples, nil)
+}
+
+// newVMPushers returns a pusher for each URL routes map measurement patterns
+// to, and one for defaultURL with the samples no route matches, if set. With
+// no routes the default pusher gets every stored sample.
+func newVMPushers(c *influxDBCollector, defaultURL string, routes map[string]string, interval time.Duration, logger log.Logger) []*vmPusher {
+	patterns := map[string][]string{}
+	var all []string
+	for pattern, url := range routes {
+		patterns[url] = append(patterns[url], pattern)
+		all = append(all, pattern)
+	}
+
+	var pushers []*vmPusher
+	for url, ps := range patterns {
+		ps := ps
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(routeCollector{c, func(m string) bool { return matchAny(ps, m) }})
+		pushers = append(pushers, newVMPusher(url, interval, reg, logger))
+	}
+	if defaultURL != "" {
+		// Not the collector itself: its Collect would also push lastPush and
+		// drain the stale markers meant for /metrics.
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(routeCollector{c, func(m string) bool { return !matchAny(all, m) }})
+		pushers = append(pushers, newVMPusher(defaultURL, interval, reg, logger))
+	}
+	return pushers
+}
+
+// vmPusher periodically pushes gathered metrics to the Prometheus import
+// endpoint of VictoriaMetrics.
+type vmPusher struct {
+	url      string
+	interval time.Duration
+	gatherer prometheus.Gatherer
+	logger   log.Logger
+	client   *http.Client
+	// Wait before the first retry, doubled for each further one.
+	backoff time.Duration
+
+	// Circuit breaker, only used from run. The breaker is open once failures
+	// reaches breakerThreshold.
+	breakerThreshold int
+	probeInterval    time.Duration
+	failures         int
+	lastAttempt      time.Time
+}
+
+func newVMPusher(url string, interval time.Duration, gatherer prometheus.Gatherer, logger log.Logger) *vmPusher {
+	return &vmPusher{
+		url:      url,
+		interval: interval,
+		gatherer: gatherer,
+		logger:   logger,
+		client:   &http.Client{Timeout: vmPushTimeout},
+		backoff:  time.Second,
+
+		breakerThreshold: *vmBreakerThreshold,
+		probeInterval:    *vmBreakerProbeInterval,
+	}
+}
+
+// run pushes metrics every interval.
+func (p *vmPusher) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := p.tick(now); err != nil {
+			level.Warn(p.logger).Log("msg", "Failed to push to VictoriaMetrics", "url", p.url, "err", err)
+		}
+	}
+}
+
+// tick pushes unless the circuit breaker is open. While it is open the
+// samples are dropped and counted instead, except for a probe push every
+// probeInterval, which closes the breaker if it succeeds.
+func (p *vmPusher) tick(now time.Time) error {
+	open := p.breakerThreshold > 0 && p.failures >= p.breakerThreshold
+	if open && now.Sub(p.lastAttempt) < p.probeInterval {
+		mfs, err := p.gatherer.Gather()
+		if err != nil {
+			return err
+		}
+		vmBreakerDropped.Add(float64(countSamples(mfs)))
+		return nil
+	}
+
+	p.lastAttempt = now
+	if err := p.push(); err != nil {
+		p.failures++
+		if p.failures == p.breakerThreshold {
+			level.Warn(p.logger).Log("msg", "Too many failed pushes, dropping samples until VictoriaMetrics recovers", "url", p.url, "failures", p.failures)
+		}
+		return err
+	}
+	if open {
+		level.Info(p.logger).Log("msg", "VictoriaMetrics recovered, resuming pushes", "url", p.url)
+	}
+	p.failures = 0
+	return nil
+}
+
+// flushOnShutdown waits for a signal and then pushes the stored samples with
+// every pusher, so that samples received since the last push are not lost.
+// It returns once all pushes are done or after timeout.
+func flushOnShutdown(sig <-chan os.Signal, pushers []*vmPusher, timeout time.Duration, logger log.Logger) {
+	s := <-sig
+	level.Info(logger).Log("msg", "Pushing samples before shutdown", "signal", s)
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, p := range pushers {
+			wg.Add(1)
+			go func(p *vmPusher) {
+				defer wg.Done()
+				if err := p.push(); err != nil {
+					level.Warn(p.logger).Log("msg", "Failed to push to VictoriaMetrics before shutdown", "url", p.url, "err", err)
+				}
+			}(p)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		level.Warn(logger).Log("msg", "Timed out pushing samples before shutdown", "timeout", timeout)
+	}
+}
+
+// push gathers metrics and sends them in batches of about vmBatchBytes of
+// text exposition. Each batch is retried, and batches that still fail are
+// dropped and counted.
+func (p *vmPusher) push() error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	var batch bytes.Buffer
+	send := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		if err := p.send(batch.Bytes()); err != nil {
+			level.Warn(p.logger).Log("msg", "Dropping VictoriaMetrics batch", "url", p.url, "err", err)
+			vmPushFailures.Inc()
+			failed++
+		}
+		batch.Reset()
+	}
+	for i := range mfs {
+		if err := encodeFamilies(context.Background(), &batch, expfmt.FmtText, mfs[i:i+1], p.logger); err != nil {
+			return err
+		}
+		if batch.Len() >= vmBatchBytes {
+			send()
+		}
+	}
+	send()
+
+	if failed > 0 {
+		return fmt.Errorf("%d batches failed", failed)
+	}
+	return nil
+}
+
+// send posts a gzip compressed batch, retrying with backoff on errors and 5xx
+// responses.
+func (p *vmPusher) send(batch []byte) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(batch)
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	backoff := p.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = p.post(body.Bytes()); err == nil || !retry || attempt == vmPushAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a single request, reporting whether a failure may be retried.
+func (p *vmPusher) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode/100 == 5, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
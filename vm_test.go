@@ -0,0 +1,312 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestVMPusher(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		payload  string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// The first attempt fails and must be retried.
+		if attempts == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		if got := r.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("got Content-Encoding %q, want gzip", got)
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Error(err)
+		}
+		payload = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=1.5\nmem value=2\n")
+	waitForSamples(t, c, 2)
+
+	p := newVMPushers(c, srv.URL+"/api/v1/import/prometheus", nil, time.Minute, log.NewNopLogger())[0]
+	p.backoff = time.Millisecond
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	for _, want := range []string{`cpu_usage{host="a"} 1.5`, "mem 2"} {
+		if !strings.Contains(payload, want) {
+			t.Errorf("payload %q does not contain %q", payload, want)
+		}
+	}
+	if strings.Contains(payload, "influxdb_last_push_timestamp_seconds") {
+		t.Errorf("payload %q contains the exporter's own metrics", payload)
+	}
+}
+
+func TestVMPusherKeepsStaleMarkers(t *testing.T) {
+	defer func(v bool) { *staleMarkers = v }(*staleMarkers)
+	*staleMarkers = true
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu value=1\n")
+	waitForSamples(t, c, 1)
+	c.expireSamples(time.Now().Add(time.Hour))
+
+	p := newVMPushers(c, srv.URL, nil, time.Minute, log.NewNopLogger())[0]
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	if mf := findFamily(gather(t, c), "cpu"); mf == nil || len(mf.Metric) != 1 {
+		t.Errorf("got family %v after a push, want a single stale marker", mf)
+	}
+}
+
+func TestVMPusherDropsFailedBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	p := newVMPusher(srv.URL, time.Minute, reg, log.NewNopLogger())
+	before := counterValue(t, vmPushFailures)
+	if err := p.push(); err == nil {
+		t.Error("expected push to fail")
+	}
+	if got := counterValue(t, vmPushFailures) - before; got != 1 {
+		t.Errorf("got %v push failures, want 1", got)
+	}
+}
+
+func TestVMRoutes(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		payloads = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(gz)
+		mu.Lock()
+		payloads[r.URL.Path] = string(b)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "infra_cpu,host=a value=1\napp_requests,app=x value=2\nother value=3\n")
+	waitForSamples(t, c, 3)
+
+	routes := map[string]string{"infra_*": srv.URL + "/infra", "app_*": srv.URL + "/app"}
+	pushers := newVMPushers(c, srv.URL+"/default", routes, time.Minute, log.NewNopLogger())
+	if len(pushers) != 3 {
+		t.Fatalf("got %d pushers, want 3", len(pushers))
+	}
+	for _, p := range pushers {
+		if err := p.push(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path, want := range map[string]string{
+		"/infra":   `infra_cpu{host="a"} 1`,
+		"/app":     `app_requests{app="x"} 2`,
+		"/default": "other 3",
+	} {
+		payload := payloads[path]
+		if !strings.Contains(payload, want) {
+			t.Errorf("%s: payload %q does not contain %q", path, payload, want)
+		}
+		if n := strings.Count(payload, "# TYPE "); n != 1 {
+			t.Errorf("%s: got %d families, want 1: %q", path, n, payload)
+		}
+	}
+}
+
+func TestFlushOnShutdown(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		payloads []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		payloads = append(payloads, string(b))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=1.5\n")
+	waitForSamples(t, c, 1)
+
+	// The interval is long enough that only the shutdown flush pushes.
+	pushers := newVMPushers(c, srv.URL, nil, time.Hour, log.NewNopLogger())
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		flushOnShutdown(sig, pushers, 5*time.Second, log.NewNopLogger())
+		close(done)
+	}()
+
+	mu.Lock()
+	if len(payloads) != 0 {
+		t.Errorf("pushed %d times before shutdown", len(payloads))
+	}
+	mu.Unlock()
+
+	sig <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush did not finish")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(payloads) != 1 || !strings.Contains(payloads[0], `cpu_usage{host="a"} 1.5`) {
+		t.Errorf("got payloads %q, want one with the pending sample", payloads)
+	}
+}
+
+func TestVMBreaker(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		down     = true
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if down {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	requestCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := requests
+		requests = 0
+		return n
+	}
+
+	c := newInfluxDBCollector(log.NewNopLogger())
+	writeLines(t, c, "cpu,host=a usage=1\n")
+	waitForSamples(t, c, 1)
+	p := newVMPushers(c, srv.URL, nil, time.Second, log.NewNopLogger())[0]
+	p.backoff = time.Millisecond
+	p.breakerThreshold = 2
+	p.probeInterval = 10 * time.Second
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := p.tick(now.Add(time.Duration(i) * time.Second)); err == nil {
+			t.Fatal("push to a down endpoint succeeded")
+		}
+	}
+	if got := requestCount(); got != 2*vmPushAttempts {
+		t.Errorf("got %d requests before the breaker opened, want %d", got, 2*vmPushAttempts)
+	}
+
+	// The breaker is open, so samples are dropped without requests.
+	before := counterValue(t, vmBreakerDropped)
+	if err := p.tick(now.Add(2 * time.Second)); err != nil {
+		t.Errorf("got error %v with an open breaker, want none", err)
+	}
+	if got := requestCount(); got != 0 {
+		t.Errorf("got %d requests with an open breaker, want 0", got)
+	}
+	if got := counterValue(t, vmBreakerDropped) - before; got != 1 {
+		t.Errorf("got %v dropped samples, want 1", got)
+	}
+
+	// A failed probe keeps the breaker open.
+	if err := p.tick(now.Add(11 * time.Second)); err == nil {
+		t.Error("probe to a down endpoint succeeded")
+	}
+	p.tick(now.Add(12 * time.Second))
+	if got := requestCount(); got != vmPushAttempts {
+		t.Errorf("got %d requests for a failed probe, want %d", got, vmPushAttempts)
+	}
+
+	// Once the endpoint is back, the next probe closes the breaker.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	for _, at := range []time.Duration{21 * time.Second, 22 * time.Second} {
+		if err := p.tick(now.Add(at)); err != nil {
+			t.Errorf("push after recovery failed: %v", err)
+		}
+	}
+	if got := requestCount(); got != 2 {
+		t.Errorf("got %d requests after recovery, want 2", got)
+	}
+}